@@ -0,0 +1,212 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// maxAssetDecimals is the most decimals an asset can have. With more, an
+// <int64> of minor units could not even hold one whole unit of a
+// reasonable size.
+const maxAssetDecimals = 12
+
+// Money is an amount of an asset. <Units> is the amount in minor units of
+// the asset, for example cents for <"USD">, so no rounding ever happens.
+// On the wire <Units> is a JSON string, since JSON numbers lose precision
+// past 2^53 in many languages.
+type Money struct {
+	Units int64 `json:",string"`
+	Asset string
+}
+
+// AssetRegistry maps the code of every asset a node accepts to the number
+// of decimals of the asset.
+type AssetRegistry map[string]int
+
+// NewAssetRegistry checks the assets of the config.
+// ----------------------------------------------------------------------------
+// It returns an error in case an asset code is not upper case letters and
+// digits or it has a negative or too large number of decimals.
+func NewAssetRegistry(assets map[string]int) (AssetRegistry, error) {
+	registry := make(AssetRegistry)
+	for code, decimals := range assets {
+		if code == "" || strings.Trim(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789") != "" {
+			return nil, fmt.Errorf("invalid asset code %q", code)
+		}
+		if decimals < 0 || decimals > maxAssetDecimals {
+			return nil, fmt.Errorf("asset %s has %d decimals, it can have 0 to %d", code, decimals, maxAssetDecimals)
+		}
+		registry[code] = decimals
+	}
+	return registry, nil
+}
+
+// Decimals returns the number of decimals of <asset>
+// ----------------------------------------------------------------------------
+// It returns an error in case <asset> is not in the registry.
+func (registry AssetRegistry) Decimals(asset string) (int, error) {
+	decimals, ok := registry[asset]
+	if !ok {
+		return 0, fmt.Errorf("unknown asset %q", asset)
+	}
+	return decimals, nil
+}
+
+// Codes returns the codes of every asset, sorted
+func (registry AssetRegistry) Codes() []string {
+	var codes []string
+	for code := range registry {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// Parse reads an amount such as <"12.50 USD"> or <"12.5">. When the text
+// has no asset code, <defaultAsset> is used.
+// ----------------------------------------------------------------------------
+// It returns an error in case the amount is not a positive decimal number,
+// has more decimals than the asset or does not fit into an <int64> of minor
+// units.
+func (registry AssetRegistry) Parse(text string, defaultAsset string) (Money, error) {
+	money, err := registry.ParseDeposit(text, defaultAsset)
+	if err != nil {
+		return Money{}, err
+	}
+	if money.Units <= 0 {
+		return Money{}, fmt.Errorf("amount has to be positive")
+	}
+	return money, nil
+}
+
+// ParseDeposit reads an amount like <Parse>, but also accepts 0. It is used
+// for the deposits of payment channels, where one side can lock nothing.
+func (registry AssetRegistry) ParseDeposit(text string, defaultAsset string) (Money, error) {
+	fields := strings.Fields(text)
+	asset := defaultAsset
+	switch len(fields) {
+	case 1:
+	case 2:
+		asset = strings.ToUpper(fields[1])
+	default:
+		return Money{}, fmt.Errorf("amount has to look like 12.50 or 12.50 %s", defaultAsset)
+	}
+	decimals, err := registry.Decimals(asset)
+	if err != nil {
+		return Money{}, err
+	}
+	units, err := parseUnits(fields[0], decimals)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{Units: units, Asset: asset}, nil
+}
+
+// parseUnits reads the decimal number <text> into minor units of an asset
+// with <decimals> decimals, without going through floating point.
+func parseUnits(text string, decimals int) (int64, error) {
+	whole, fraction := text, ""
+	if index := strings.IndexByte(text, '.'); index >= 0 {
+		whole, fraction = text[:index], text[index+1:]
+	}
+	if whole == "" && fraction == "" {
+		return 0, fmt.Errorf("invalid amount %q", text)
+	}
+	if strings.Trim(whole+fraction, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid amount %q", text)
+	}
+	// trailing zeros are fine, <"1.500"> is a valid amount in cents
+	fraction = strings.TrimRight(fraction, "0")
+	if len(fraction) > decimals {
+		return 0, fmt.Errorf("amount %q has more than %d decimals", text, decimals)
+	}
+	digits := strings.TrimLeft(whole+fraction+strings.Repeat("0", decimals-len(fraction)), "0")
+	var units int64
+	for _, digit := range digits {
+		if units > (math.MaxInt64-int64(digit-'0'))/10 {
+			return 0, fmt.Errorf("amount %q is too large", text)
+		}
+		units = units*10 + int64(digit-'0')
+	}
+	return units, nil
+}
+
+// Format writes <money> as a decimal number with its asset code, such as
+// <"12.50 USD">. An unknown asset is shown in minor units.
+func (registry AssetRegistry) Format(money Money) string {
+	decimals, err := registry.Decimals(money.Asset)
+	if err != nil {
+		return fmt.Sprintf("%d minor units of %s", money.Units, money.Asset)
+	}
+	return formatUnits(money.Units, decimals) + " " + money.Asset
+}
+
+// formatUnits writes <units> minor units of an asset with <decimals>
+// decimals as a decimal number
+func formatUnits(units int64, decimals int) string {
+	sign := ""
+	// the magnitude is kept as <uint64> so that the smallest <int64> works
+	magnitude := uint64(units)
+	if units < 0 {
+		sign = "-"
+		magnitude = uint64(-(units + 1)) + 1
+	}
+	digits := fmt.Sprintf("%0*d", decimals+1, magnitude)
+	if decimals == 0 {
+		return sign + digits
+	}
+	return sign + digits[:len(digits)-decimals] + "." + digits[len(digits)-decimals:]
+}
+
+// Validate checks that <money> is a positive amount of an asset in the
+// registry. It is used on amounts that come from other nodes.
+func (registry AssetRegistry) Validate(money Money) error {
+	if _, err := registry.Decimals(money.Asset); err != nil {
+		return err
+	}
+	if money.Units <= 0 {
+		return fmt.Errorf("amount has to be positive, got %d", money.Units)
+	}
+	return nil
+}
+
+// addUnits adds <a> and <b>
+// ----------------------------------------------------------------------------
+// It returns an error in case the sum does not fit into an <int64>.
+func addUnits(a int64, b int64) (int64, error) {
+	if (b > 0 && a > math.MaxInt64-b) || (b < 0 && a < math.MinInt64-b) {
+		return 0, fmt.Errorf("amount overflows")
+	}
+	return a + b, nil
+}
+
+// Assets returns the assets <node> accepts
+func (node *PeerNode) Assets() AssetRegistry {
+	return node.assets
+}
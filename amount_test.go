@@ -0,0 +1,140 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// TestParseUnits reads amounts into minor units of assets with different
+// numbers of decimals
+func TestParseUnits(t *testing.T) {
+	tests := []struct {
+		text     string
+		decimals int
+		units    int64
+		fails    bool
+	}{
+		{text: "12", decimals: 2, units: 1200},
+		{text: "12.5", decimals: 2, units: 1250},
+		{text: ".5", decimals: 2, units: 50},
+		{text: "1.500", decimals: 2, units: 150},
+		{text: "1.5000000000", decimals: 2, units: 150},
+		{text: "1.005", decimals: 2, fails: true},
+		{text: "0.000000001", decimals: 8, fails: true},
+		{text: "7", decimals: 0, units: 7},
+		{text: "7.0", decimals: 0, units: 7},
+		{text: "7.5", decimals: 0, fails: true},
+		{text: "9223372036854775807", decimals: 0, units: math.MaxInt64},
+		{text: "9223372036854775808", decimals: 0, fails: true},
+		{text: "92233720368547758.07", decimals: 2, units: math.MaxInt64},
+		{text: "92233720368547758.08", decimals: 2, fails: true},
+		{text: "99999999999999999999", decimals: 0, fails: true},
+		{text: "", decimals: 2, fails: true},
+		{text: ".", decimals: 2, fails: true},
+		{text: "-1", decimals: 2, fails: true},
+		{text: "1.2.3", decimals: 2, fails: true},
+		{text: "1e3", decimals: 2, fails: true},
+	}
+	for _, test := range tests {
+		units, err := parseUnits(test.text, test.decimals)
+		if test.fails {
+			if err == nil {
+				t.Errorf("parseUnits(%q, %d) = %d, expected an error", test.text, test.decimals, units)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseUnits(%q, %d) failed: %s", test.text, test.decimals, err)
+			continue
+		}
+		if units != test.units {
+			t.Errorf("parseUnits(%q, %d) = %d, expected %d", test.text, test.decimals, units, test.units)
+		}
+	}
+}
+
+// TestFormatUnits writes minor units as decimal numbers, down to the
+// smallest <int64>
+func TestFormatUnits(t *testing.T) {
+	tests := []struct {
+		units    int64
+		decimals int
+		text     string
+	}{
+		{units: 1250, decimals: 2, text: "12.50"},
+		{units: 5, decimals: 2, text: "0.05"},
+		{units: -5, decimals: 2, text: "-0.05"},
+		{units: 0, decimals: 2, text: "0.00"},
+		{units: 7, decimals: 0, text: "7"},
+		{units: -7, decimals: 0, text: "-7"},
+		{units: 1, decimals: 8, text: "0.00000001"},
+		{units: math.MaxInt64, decimals: 2, text: "92233720368547758.07"},
+		{units: math.MinInt64, decimals: 2, text: "-92233720368547758.08"},
+		{units: math.MinInt64, decimals: 0, text: "-9223372036854775808"},
+	}
+	for _, test := range tests {
+		text := formatUnits(test.units, test.decimals)
+		if text != test.text {
+			t.Errorf("formatUnits(%d, %d) = %q, expected %q", test.units, test.decimals, text, test.text)
+		}
+	}
+}
+
+// TestAddUnits adds minor units and refuses sums that do not fit into an
+// <int64>
+func TestAddUnits(t *testing.T) {
+	tests := []struct {
+		a     int64
+		b     int64
+		sum   int64
+		fails bool
+	}{
+		{a: 1, b: 2, sum: 3},
+		{a: 5, b: -7, sum: -2},
+		{a: math.MaxInt64, b: 0, sum: math.MaxInt64},
+		{a: math.MaxInt64, b: math.MinInt64, sum: -1},
+		{a: math.MaxInt64, b: 1, fails: true},
+		{a: math.MinInt64, b: -1, fails: true},
+		{a: math.MinInt64, b: math.MinInt64, fails: true},
+	}
+	for _, test := range tests {
+		sum, err := addUnits(test.a, test.b)
+		if test.fails {
+			if err == nil {
+				t.Errorf("addUnits(%d, %d) = %d, expected an error", test.a, test.b, sum)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("addUnits(%d, %d) failed: %s", test.a, test.b, err)
+			continue
+		}
+		if sum != test.sum {
+			t.Errorf("addUnits(%d, %d) = %d, expected %d", test.a, test.b, sum, test.sum)
+		}
+	}
+}
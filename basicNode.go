@@ -29,12 +29,21 @@ import (
 	"crypto/rand"
 	"fmt"
 	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
 	libp2p "github.com/libp2p/go-libp2p"
+	pnet "github.com/libp2p/go-libp2p-core/pnet"
 	crypto "github.com/libp2p/go-libp2p-crypto"
 	host "github.com/libp2p/go-libp2p-host"
 	peer "github.com/libp2p/go-libp2p-peer"
 	peerstore "github.com/libp2p/go-libp2p-peerstore"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	tcp "github.com/libp2p/go-tcp-transport"
+	websocket "github.com/libp2p/go-ws-transport"
 	multiaddr "github.com/multiformats/go-multiaddr"
 )
 
@@ -42,6 +51,55 @@ import (
 // so that using receiver style function calls becomes possible
 type PeerNode struct {
 	host.Host
+	// heartbeatSequence and transactionNonce are only used through
+	// <sync/atomic>
+	heartbeatSequence uint64
+	transactionNonce  uint64
+	started           time.Time
+	gater             *ConnectionGater
+	privateNetwork    bool
+	// healthServer is the HTTP server of <StartHealthServer>, it is shut
+	// down when the node is closed
+	healthServer *http.Server
+	// syncDirectory is where <RequestSync> stores the files it receives.
+	// When it is empty the working directory is used.
+	syncDirectory string
+	// context is cancelled by <Close> to stop the background work of the
+	// node, such as renewing relay reservations
+	context context.Context
+	cancel  context.CancelFunc
+
+	reservationMutex sync.Mutex
+	reservations     map[peer.ID]context.CancelFunc
+
+	reachabilityMutex sync.RWMutex
+	reachability      []AddressReachability
+	// circuitAddresses are the <"/p2p-circuit"> addresses of the relays
+	// <node> reserved a slot on
+	circuitAddresses []string
+
+	monitor          *HeartbeatMonitor
+	latency          *LatencyTracker
+	detector         *FailureDetector
+	membership       *Membership
+	heartbeatLimiter *HeartbeatLimiter
+	history          *HeartbeatHistory
+	presence         *Presence
+	ledger           *Ledger
+	assets           AssetRegistry
+	receipts         string
+	// received keeps the transactions we received when there is no
+	// <ledger>, so replays are refused without one too
+	received *receivedTransactions
+	// channelDepositLimits is how much we lock at most, per asset, when
+	// another node opens a channel with us
+	channelDepositLimits map[string]int64
+
+	channelMutex sync.Mutex
+	channelsBusy map[string]bool
+	// channelOpenMutex makes the acceptor handle one open at a time, so a
+	// repeated open cannot lock a deposit twice
+	channelOpenMutex sync.Mutex
 }
 
 // InitializePeer function is the starting point for any P2P application.
@@ -49,10 +107,12 @@ type PeerNode struct {
 // ----------------------------------------------------------------------------
 // <SourcePort> is an integer parameter that indicates which port the process
 // sends or receives packets FROM
+// <config> is a parameter of pointer type to <Config> that holds the
+// settings of the node
 // ----------------------------------------------------------------------------
 // It returns a pointer to a *PeerNode struct type so that it can be used as a
 // receiver type.
-func InitializePeer(sourcePort int) *PeerNode {
+func InitializePeer(sourcePort int, config *Config) *PeerNode {
 	var r io.Reader
 	r = rand.Reader
 	var result *PeerNode
@@ -66,26 +126,208 @@ func InitializePeer(sourcePort int) *PeerNode {
 	// Generate a IP4 TCp multi address and point it to 0.0.0.0 as a way to say that
 	// It accepts all connections.
 	sourceMultiAddr, _ := multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", sourcePort))
-	// Use the current context, generated private key as Identity and attach
-	// the generated multi address the links to 0.0.0.0 to create a new peer Node
+	listenAddrs := []multiaddr.Multiaddr{sourceMultiAddr}
+	// Also listen for WebSocket connections so that browsers and clients
+	// that can only get through HTTP proxies can reach the node.
+	if !config.DisableWebSocket {
+		webSocketMultiAddr, err := multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/0.0.0.0/tcp/%d/ws", config.WebSocketPort))
+		if err != nil {
+			panic(err)
+		}
+		listenAddrs = append(listenAddrs, webSocketMultiAddr)
+	}
+	// Load the allow and deny lists from disk. The gater is handed to libp2p
+	// so that every connection, incoming or outgoing, is checked against it.
+	gater, err := LoadConnectionGater(config.ACLFile)
+	if err != nil {
+		panic(err)
+	}
+	// Use the generated private key as Identity and attach the generated
+	// multi addresses the link to 0.0.0.0
 	// 0.0.0.0 tells our host to accept all addresses
-	// <Context package> 		https://golang.org/pkg/context/
-	node, err := libp2p.New(
-		context.Background(),
-		libp2p.ListenAddrs(sourceMultiAddr),
+	options := []libp2p.Option{
+		libp2p.ListenAddrs(listenAddrs...),
 		libp2p.Identity(privateKey),
-	)
+		// the agent version is what other nodes see in identify and in
+		// <"/heartbeat/2.0.0"> messages
+		libp2p.UserAgent(agentVersion),
+		// The transports are set explicitly: TCP and WebSocket. QUIC is
+		// left out because it cannot run inside a private network.
+		libp2p.Transport(tcp.NewTCPTransport),
+		libp2p.Transport(websocket.New),
+		libp2p.ConnectionGater(gater),
+		// Allow the node to dial and to be reached through
+		// <"/p2p-circuit"> addresses of relay nodes.
+		libp2p.EnableRelay(),
+		// Answer dial back requests of other nodes that want to know
+		// which of their addresses are reachable.
+		libp2p.EnableNATService(),
+	}
+	// A relay node forwards traffic for other nodes. Every relayed
+	// connection is limited to <RelayMaxDuration> and <RelayMaxData>, so
+	// that a relay cannot be used to move unlimited traffic. The defaults of
+	// circuit relay v2 (two minutes and 128 KiB) are too small for a sync,
+	// so the limits come from the config.
+	if config.RelayService {
+		options = append(options, libp2p.EnableRelayService(relayv2.WithLimit(&relayv2.RelayLimit{
+			Duration: config.RelayMaxDuration.Duration,
+			Data:     config.RelayMaxData,
+		})))
+	}
+	// If the config names a pre-shared key, the node only talks to nodes
+	// that have the same key. Every connection is encrypted with the key
+	// before the libp2p handshake, so nodes without it fail the handshake.
+	privateNetwork := config.PrivateNetworkKeyFile != ""
+	if privateNetwork {
+		psk, err := loadPrivateNetworkKey(config.PrivateNetworkKeyFile)
+		if err != nil {
+			panic(err)
+		}
+		options = append(options, libp2p.PrivateNetwork(psk))
+	}
+	// Use the current context and the options to create a new peer Node
+	// <Context package> 		https://golang.org/pkg/context/
+	node, err := libp2p.New(context.Background(), options...)
 	if err != nil {
 		panic(err)
 	}
 	// Show the created node properties on display and return a pointer to it.
 	fmt.Printf("Node PeerID:\t%s\n", node.ID())
-	fmt.Printf("\n%s/ipfs/%s\n", node.Addrs()[0].String(), node.ID().Pretty())
-	result = &PeerNode{node}
+	if privateNetwork {
+		fmt.Printf("Private Network:\tenabled (%s)\n", config.PrivateNetworkKeyFile)
+	} else {
+		fmt.Printf("Private Network:\tdisabled\n")
+	}
+	if config.RelayService {
+		fmt.Printf("Relay Service:\tenabled (%s and %d bytes per connection)\n", config.RelayMaxDuration, config.RelayMaxData)
+	}
+	result = wrapHost(node, gater, config)
+	result.privateNetwork = privateNetwork
+	// Only the node of the shell keeps a heartbeat history, so helper nodes
+	// like the WebSocket client do not write to the same file.
+	if config.HistoryFile != "" {
+		result.history, err = OpenHeartbeatHistory(config.HistoryFile, config.HistoryRetention.Duration)
+		if err != nil {
+			panic(err)
+		}
+	}
+	// Reserve a slot on every relay in the config and show the addresses
+	// other nodes can use to reach this node through them.
+	var circuitAddresses []string
+	for _, relayAddress := range config.Relays {
+		circuitAddress, err := result.ReserveRelay(relayAddress)
+		if err != nil {
+			fmt.Printf("Relay %s: %s\n", relayAddress, err)
+			continue
+		}
+		circuitAddresses = append(circuitAddresses, circuitAddress)
+	}
+	// With helpers in the config, the node finds out at startup whether one
+	// of its addresses can be dialed from outside, so the banner and the
+	// first payments already use a reachable address: a public one if there
+	// is one, otherwise the address of a relay.
+	if len(config.ReachabilityHelpers) > 0 {
+		for _, checked := range result.CheckReachability(config.ReachabilityHelpers) {
+			fmt.Printf("Reachability:\t%-10s %s\n", checked.Reachability, checked.Address)
+		}
+	}
+	// <node.Addrs()[0]> is usually the loopback address, so the address
+	// that other nodes are most likely to reach is shown instead.
+	fmt.Printf("\n%s\n", result.advertisedAddress())
+	for _, circuitAddress := range circuitAddresses {
+		fmt.Printf("%s\n", circuitAddress)
+	}
+	if config.LedgerFile != "" {
+		result.ledger, err = OpenLedger(config.LedgerFile, result.assets, config.CreditLimits, config.DefaultAsset)
+		if err != nil {
+			panic(err)
+		}
+	}
+	result.receipts = config.ReceiptsDirectory
+	if config.Presence {
+		err = result.Presence().Start()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Presence:\t%s\n", config.PresenceTopic)
+	}
+	if config.HealthAddress != "" {
+		healthAddress, err := result.StartHealthServer(config.HealthAddress)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Health Server:\thttp://%s/healthz\n", healthAddress)
+	}
 
 	return result
 }
 
+// PrivateNetwork reports whether <node> is running inside a private network
+// that is protected by a pre-shared key.
+func (node *PeerNode) PrivateNetwork() bool {
+	return node.privateNetwork
+}
+
+// Close stops the background work of <node> and closes its libp2p host
+func (node *PeerNode) Close() error {
+	node.cancel()
+	return node.Host.Close()
+}
+
+// wrapHost wraps <node> into a <PeerNode> and sets up the state that the
+// protocols of this repo keep next to the host.
+// ----------------------------------------------------------------------------
+// <node> is a parameter of <host.Host> type that is the libp2p host.
+// <gater> is a parameter of pointer type to <ConnectionGater> that <node>
+// was created with.
+// <config> is a parameter of pointer type to <Config> that holds the
+// settings of the node.
+// ----------------------------------------------------------------------------
+// It returns a pointer to a *PeerNode struct type
+func wrapHost(node host.Host, gater *ConnectionGater, config *Config) *PeerNode {
+	result := &PeerNode{Host: node, gater: gater, started: time.Now()}
+	result.context, result.cancel = context.WithCancel(context.Background())
+	result.reservations = make(map[peer.ID]context.CancelFunc)
+	// the nonces of our transactions start at the current time. With a
+	// ledger, the last nonce is also stored, so they keep growing across
+	// restarts even if the clock goes back.
+	result.transactionNonce = uint64(result.started.UnixNano())
+	result.received = newReceivedTransactions()
+	result.monitor = NewHeartbeatMonitor(result, config)
+	result.latency = NewLatencyTracker(config.LatencyWindow)
+	result.detector = NewFailureDetector(result.context, config)
+	result.membership = NewMembership(result, config)
+	result.heartbeatLimiter = NewHeartbeatLimiter(config)
+	result.presence = NewPresence(result, config)
+	assets, err := NewAssetRegistry(config.Assets)
+	if err != nil {
+		panic(err)
+	}
+	result.assets = assets
+	result.channelDepositLimits, err = parseChannelDepositLimits(assets, config.ChannelDepositLimits)
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+// Monitor returns the heartbeat monitor of <node>
+func (node *PeerNode) Monitor() *HeartbeatMonitor {
+	return node.monitor
+}
+
+// loadPrivateNetworkKey reads the pre-shared key of a private network from
+// <path>. The file is in the same format that <GeneratePrivateNetworkKey>
+// writes and that other libp2p implementations use.
+func loadPrivateNetworkKey(path string) (pnet.PSK, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return pnet.DecodeV1PSK(file)
+}
+
 // addAddressToPeerstore function adds an address to a node's address book
 // ----------------------------------------------------------------------------
 // <node> is a parameter of struct type host.Host is the node we want to add a
@@ -96,36 +338,19 @@ func InitializePeer(sourcePort int) *PeerNode {
 // It returns a peer.ID which is the decoded peer.ID of <address>
 // It also returs an error to be used in case it is needed
 func addAddressToPeerstore(node host.Host, address string) (peer.ID, error) {
-	var result peer.ID
-	// Encapsulate the given string <address> into a multiaddress variable called
-	// <ipfsAddress>
-	ipfsAddress, err := multiaddr.NewMultiaddr(address)
+	// use <splitIpfsAddress> to split <address> into the multiaddress
+	// <targetAddress> that is used to reach the peer and the <decodedPeerID>
+	// of the peer itself.
+	targetAddress, decodedPeerID, err := splitIpfsAddress(address)
 	if err != nil {
-		return result, err
+		return decodedPeerID, err
 	}
-	// use <ValueForProtocol(multiaddr.[...])> function to turn back the <ipfsAddress>
-	// multiaddress into it's full base 58 representation <peerIDString>
-	peerIDString, err := ipfsAddress.ValueForProtocol(multiaddr.P_IPFS)
-	if err != nil {
-		return result, err
-	}
-	// We generate a full address form by creating a new multiaddress and
-	// passing the bsse 58 encoded address to generate target peer address
-	targetPeerAddress, _ := multiaddr.NewMultiaddr(
-		fmt.Sprintf("/ipfs/%s", peerIDString))
-
-	// decode <peerIDString> base 58 representation into <decodedPeerID>
-	decodedPeerID, err := peer.IDB58Decode(peerIDString)
-	if err != nil {
-		return result, err
+	// use the following function to add them to address book. An address
+	// that is only a peer ID has nothing to add.
+	if targetAddress != nil {
+		node.Peerstore().AddAddr(decodedPeerID, targetAddress, peerstore.PermanentAddrTTL)
 	}
-	result = decodedPeerID
-	// We use decapsulate target peer address multiwrapper, and decoded peer
-	// add use the following function to add them to address book
-	targetAddress := ipfsAddress.Decapsulate(targetPeerAddress)
-	node.Peerstore().AddAddr(decodedPeerID, targetAddress, peerstore.PermanentAddrTTL)
-
-	return result, err
+	return decodedPeerID, nil
 }
 
 // IpfsAddressToPeerID turns a IPFS address into its corresponding peer ID
@@ -136,25 +361,52 @@ func addAddressToPeerstore(node host.Host, address string) (peer.ID, error) {
 // <peer.ID> is the result we are looking for
 // it returns an error in case there is an issue in converting the string into peer.ID
 func IpfsAddressToPeerID(address string) (peer.ID, error) {
+	_, decodedPeerID, err := splitIpfsAddress(address)
+	return decodedPeerID, err
+}
+
+// splitIpfsAddress splits an IPFS address into the multiaddress that is
+// dialed and the peer ID at its end.
+// Relay addresses such as
+// </ip4/1.2.3.4/tcp/4001/ipfs/<relay>/p2p-circuit/ipfs/<target>> hold more
+// than one peer ID, and only the last one is the peer we want to reach, so the
+// last component is used instead of the first <"/ipfs"> value.
+// ----------------------------------------------------------------------------
+// <address> is a parameter of string type that is of IPFS address type
+// ----------------------------------------------------------------------------
+// it returns the multiaddress without the peer ID (nil if there is nothing
+// left), the decoded <peer.ID> and an error in case <address> is not valid
+func splitIpfsAddress(address string) (multiaddr.Multiaddr, peer.ID, error) {
 	var result peer.ID
 	// Encapsulate the given string <address> into a multiaddress variable called
 	// <ipfsAddress>
 	ipfsAddress, err := multiaddr.NewMultiaddr(address)
 	if err != nil {
-		return result, err
+		return nil, result, err
 	}
-	// use <ValueForProtocol(multiaddr.[...])> function to turn back the <ipfsAddress>
-	// multiaddress into it's full base 58 representation <peerIDString>.
-	peerIDString, err := ipfsAddress.ValueForProtocol(multiaddr.P_IPFS)
-	if err != nil {
-		return result, err
+	// use <SplitLast> to take off the last component of <ipfsAddress>,
+	// which has to be the base 58 representation of the peer ID.
+	targetAddress, lastComponent := multiaddr.SplitLast(ipfsAddress)
+	if lastComponent == nil || lastComponent.Protocol().Code != multiaddr.P_IPFS {
+		return nil, result, fmt.Errorf("%s does not end with /ipfs/<peer ID>", address)
 	}
-	// decode <peerIDString> base 58 representation into <decodedPeerID>
-	decodedPeerID, err := peer.IDB58Decode(peerIDString)
+	// decode the base 58 representation into <decodedPeerID>
+	decodedPeerID, err := peer.IDB58Decode(lastComponent.Value())
 	if err != nil {
-		return result, err
+		return nil, result, err
+	}
+	return targetAddress, decodedPeerID, nil
+}
+
+// parsePeerID turns the user input into a peer ID. The input can either be a
+// plain base 58 peer ID or a full IPFS address.
+// ----------------------------------------------------------------------------
+// <input> is a parameter of string type that is either of the two forms
+// ----------------------------------------------------------------------------
+// it returns the decoded <peer.ID> or an error
+func parsePeerID(input string) (peer.ID, error) {
+	if strings.HasPrefix(input, "/") {
+		return IpfsAddressToPeerID(input)
 	}
-	// return <decodedPeerID> or error
-	result = decodedPeerID
-	return result, err
+	return peer.IDB58Decode(input)
 }
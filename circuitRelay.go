@@ -0,0 +1,282 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	network "github.com/libp2p/go-libp2p-core/network"
+	client "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+	multiaddr "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// streamContext returns the context that is passed to <NewStream>.
+// Connections through a circuit relay v2 are "transient": libp2p refuses to
+// open streams on them unless the context says it is fine to do so. Every
+// protocol of this repo is small enough to run over a relay, so all of them
+// use this context.
+// ----------------------------------------------------------------------------
+// <protocol> is the protocol the stream is opened for. It is only used as the
+// reason that is recorded with the context.
+func streamContext(protocol string) context.Context {
+	return network.WithUseTransient(context.Background(), protocol)
+}
+
+// ReserveRelay asks a relay node to keep a slot for <node> so that peers that
+// cannot dial <node> directly can reach it through the relay.
+// The reservation expires after a while, so it is renewed in the background
+// until the node is closed or reserves a slot on the same relay again.
+// ----------------------------------------------------------------------------
+// <node> is a receiver of pointer type to <PeerNode>.
+// <relayAddress> is a parameter of string type that is the IPFS address of a
+// node that runs with <RelayService> enabled.
+// ----------------------------------------------------------------------------
+// it returns the <"/p2p-circuit"> address other nodes can use to reach
+// <node> through the relay.
+// It returns an error in case the relay refuses the reservation.
+func (node *PeerNode) ReserveRelay(relayAddress string) (string, error) {
+	relayID, err := addAddressToPeerstore(node, relayAddress)
+	if err != nil {
+		return "", err
+	}
+	relayInfo := node.Peerstore().PeerInfo(relayID)
+	reservation, err := client.Reserve(node.context, node, relayInfo)
+	if err != nil {
+		return "", err
+	}
+	// only one renewal runs per relay, the one of the newest reservation
+	renewal, stop := context.WithCancel(node.context)
+	node.reservationMutex.Lock()
+	if previous, ok := node.reservations[relayID]; ok {
+		previous()
+	}
+	node.reservations[relayID] = stop
+	node.reservationMutex.Unlock()
+	// renew the reservation one minute before it expires. If the relay is
+	// gone, try again every minute.
+	go func() {
+		expiration := reservation.Expiration
+		for {
+			timer := time.NewTimer(time.Until(expiration) - time.Minute)
+			select {
+			case <-renewal.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			renewed, err := client.Reserve(renewal, node, relayInfo)
+			if renewal.Err() != nil {
+				return
+			}
+			if err != nil {
+				fmt.Printf("Relay %s: could not renew reservation: %s\n", relayID, err)
+				expiration = time.Now().Add(2 * time.Minute)
+				continue
+			}
+			expiration = renewed.Expiration
+		}
+	}()
+	// The circuit address is the relay address followed by <"/p2p-circuit">
+	// and the peer ID of <node>. It is kept, so that it can be advertised
+	// when none of our own addresses is reachable.
+	circuitAddress := fmt.Sprintf("%s/p2p-circuit/ipfs/%s", relayAddress, node.ID().Pretty())
+	node.reachabilityMutex.Lock()
+	known := false
+	for _, address := range node.circuitAddresses {
+		if address == circuitAddress {
+			known = true
+			break
+		}
+	}
+	if !known {
+		node.circuitAddresses = append(node.circuitAddresses, circuitAddress)
+	}
+	node.reachabilityMutex.Unlock()
+	return circuitAddress, nil
+}
+
+// loopbackAddress returns the IPFS address of <node> on the loopback
+// interface. It is used to connect nodes that run in the same process.
+func (node *PeerNode) loopbackAddress() string {
+	for _, address := range node.Addrs() {
+		if manet.IsIPLoopback(address) {
+			return fmt.Sprintf("%s/ipfs/%s", address, node.ID().Pretty())
+		}
+	}
+	return fmt.Sprintf("%s/ipfs/%s", node.Addrs()[0], node.ID().Pretty())
+}
+
+// RelayDemoReport is a struct that holds what the relay demo did, so that
+// it can be shown in the shell and checked by the tests.
+// <SenderBalance> is the balance of the sender with the target and
+// <TargetBalance> the balance of the target with the sender after the
+// payment. <Connections> are the remote addresses of every connection from
+// the sender to the target.
+type RelayDemoReport struct {
+	Heartbeat     *HeartbeatResult
+	SenderBalance Money
+	TargetBalance Money
+	Synced        bool
+	Connections   []string
+}
+
+// RelayDemo starts three nodes in the current process to show that heartbeat,
+// payment and sync work over a relayed connection:
+// <relay> runs the relay service, <target> reserves a slot on <relay> and
+// <sender> only knows the <"/p2p-circuit"> address of <target>.
+// Sync is only run when there is a <data> directory to send.
+// ----------------------------------------------------------------------------
+// <config> is a parameter of pointer type to <Config> that the three nodes
+// are created with.
+// ----------------------------------------------------------------------------
+// It returns an error in case the relayed connection could not be set up or
+// one of the protocols failed over it.
+func RelayDemo(config *Config) error {
+	// the ledgers of the demo nodes and the files the sender syncs are kept
+	// in a temporary directory, so they do not touch the files of the node
+	// of the shell and the <data> directory the target sends
+	directory, err := ioutil.TempDir("", "relay-demo")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(directory)
+	report, err := runRelayDemo(config, directory)
+	if err != nil {
+		return err
+	}
+	if report.Synced {
+		fmt.Println("Heartbeat, payment and sync worked over the relay")
+	} else {
+		fmt.Println("Heartbeat and payment worked over the relay")
+	}
+	return nil
+}
+
+// runRelayDemo does the work of <RelayDemo>. The demo nodes keep their
+// ledgers in <directory> and the sender syncs into <directory>/sync.
+// ----------------------------------------------------------------------------
+// it returns a pointer to <RelayDemoReport> with what the demo did.
+// It returns an error in case a step of the demo failed, or the sender
+// reached the target without the relay.
+func runRelayDemo(config *Config, directory string) (*RelayDemoReport, error) {
+	// The demo nodes run next to the node of the shell, so they cannot
+	// share its files and ports.
+	demoConfig := *config
+	demoConfig.HistoryFile = ""
+	demoConfig.HealthAddress = ""
+	demoConfig.LedgerFile = ""
+	demoConfig.ReceiptsDirectory = ""
+	demoConfig.Presence = false
+	relayConfig := demoConfig
+	relayConfig.RelayService = true
+	relayConfig.Relays = nil
+	targetConfig := demoConfig
+	targetConfig.RelayService = false
+	targetConfig.Relays = nil
+	targetConfig.LedgerFile = filepath.Join(directory, "target.db")
+	senderConfig := targetConfig
+	senderConfig.LedgerFile = filepath.Join(directory, "sender.db")
+	syncDirectory := filepath.Join(directory, "sync")
+	err := os.MkdirAll(syncDirectory, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("---------------- relay ----------------")
+	relay := InitializePeer(0, &relayConfig)
+	defer relay.Close()
+	fmt.Println("---------------- target ---------------")
+	target := InitializePeer(0, &targetConfig)
+	defer target.Close()
+	fmt.Println("---------------- sender ---------------")
+	sender := InitializePeer(0, &senderConfig)
+	defer sender.Close()
+	fmt.Println("---------------------------------------")
+	sender.syncDirectory = syncDirectory
+
+	target.HeartbeatProtocolMultiplexer()
+	target.PaymentProtocolMultiplexer()
+	target.SyncProtocolMultiplexer()
+	circuitAddress, err := target.ReserveRelay(relay.loopbackAddress())
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Target is reachable at %s\n", circuitAddress)
+
+	report := &RelayDemoReport{}
+	report.Heartbeat, err = sender.checkHeartbeat(circuitAddress)
+	if err != nil {
+		return nil, fmt.Errorf("heartbeat over the relay: %s", err)
+	}
+	fmt.Printf("Heartbeat over relay answered in %s\n", report.Heartbeat.RTT)
+	amount := Money{Units: 1, Asset: config.DefaultAsset}
+	_, err = sender.sendPayment(circuitAddress, amount, "")
+	if err != nil {
+		return nil, fmt.Errorf("payment over the relay: %s", err)
+	}
+	report.SenderBalance, err = sender.ledger.Balance(target.ID(), amount.Asset)
+	if err != nil {
+		return nil, err
+	}
+	report.TargetBalance, err = target.ledger.Balance(sender.ID(), amount.Asset)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat("data"); err == nil {
+		err = sender.requestSync(circuitAddress)
+		if err != nil {
+			return nil, fmt.Errorf("sync over the relay: %s", err)
+		}
+		report.Synced = true
+		fmt.Println("Sync over relay finished")
+	} else {
+		fmt.Println("Skipping sync: there is no data directory")
+	}
+	// Every connection between sender and target has to be a relayed one,
+	// and there has to be one, otherwise the demo did not test anything.
+	conns := sender.Network().ConnsToPeer(target.ID())
+	if len(conns) == 0 {
+		return nil, fmt.Errorf("sender has no connection to target")
+	}
+	for _, conn := range conns {
+		if !isRelayedAddress(conn.RemoteMultiaddr()) {
+			return nil, fmt.Errorf("sender reached target directly at %s", conn.RemoteMultiaddr())
+		}
+		report.Connections = append(report.Connections, conn.RemoteMultiaddr().String())
+	}
+	return report, nil
+}
+
+// isRelayedAddress checks if <address> goes through a circuit relay
+func isRelayedAddress(address multiaddr.Multiaddr) bool {
+	return strings.Contains(address.String(), "/p2p-circuit")
+}
@@ -0,0 +1,92 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestRelayDemo starts a relay, a target and a sender on loopback and runs
+// heartbeat, payment and sync from the sender to the target through the
+// relay. The test runs in a temporary directory with its own <data>
+// directory for the target to send.
+func TestRelayDemo(t *testing.T) {
+	config := testConfig(t)
+	directory := t.TempDir()
+	err := os.MkdirAll(filepath.Join(directory, "data"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(directory, "data", "hello.txt"), []byte("hello over the relay\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	workingDirectory, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(workingDirectory)
+
+	demoDirectory := t.TempDir()
+	report, err := runRelayDemo(config, demoDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Heartbeat == nil || report.Heartbeat.RTT <= 0 {
+		t.Fatalf("heartbeat over the relay was not answered: %+v", report.Heartbeat)
+	}
+	if report.SenderBalance.Units != -1 {
+		t.Fatalf("sender booked %d instead of -1", report.SenderBalance.Units)
+	}
+	if report.TargetBalance.Units != 1 {
+		t.Fatalf("target booked %d instead of 1", report.TargetBalance.Units)
+	}
+	if !report.Synced {
+		t.Fatal("sync did not run")
+	}
+	synced, err := ioutil.ReadFile(filepath.Join(demoDirectory, "sync", "data", "hello.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(synced) != "hello over the relay\n" {
+		t.Fatalf("synced file holds %q", synced)
+	}
+	if len(report.Connections) == 0 {
+		t.Fatal("sender has no connection to target")
+	}
+	for _, address := range report.Connections {
+		if !strings.Contains(address, "/p2p-circuit") {
+			t.Fatalf("sender reached target at %s without the relay", address)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// defaultConfigFile is the file the node reads its settings from when no
+// other file is given with the <-config> flag.
+const defaultConfigFile = "config.json"
+
+// Config is a struct that holds the settings of a node. Every field has a
+// default value so the config file only needs the fields that change.
+type Config struct {
+	// ACLFile is the file the access control lists are saved to.
+	ACLFile string
+	// PrivateNetworkKeyFile is the file that holds the pre-shared key of a
+	// private network. When it is empty the node joins the public network.
+	PrivateNetworkKeyFile string
+	// RelayService makes the node act as a circuit relay v2 for peers that
+	// cannot be dialed directly.
+	RelayService bool
+	// RelayMaxDuration is how long a relay node keeps a relayed connection
+	// open before it resets it.
+	RelayMaxDuration Duration
+	// RelayMaxData is how many bytes a relay node forwards in each
+	// direction of a relayed connection before it resets it.
+	RelayMaxData int64
+	// Relays are the IPFS addresses of relay nodes that the node reserves a
+	// slot on at startup, so that it can be reached from behind a NAT.
+	Relays []string
+	// ReachabilityHelpers are the IPFS addresses of the nodes that are asked
+	// to dial us back by the reachability check. When it is empty, the
+	// connected peers are asked.
+	ReachabilityHelpers []string
+	// DisableWebSocket turns off the WebSocket listener that runs next to
+	// the TCP one.
+	DisableWebSocket bool
+	// WebSocketPort is the port of the WebSocket listener. When it is 0 the
+	// operating system picks a free port.
+	WebSocketPort int
+	// HeartbeatInterval is how often the heartbeat monitor checks every
+	// monitored peer.
+	HeartbeatInterval Duration
+	// HeartbeatTimeout is how long the monitor waits for a reply.
+	HeartbeatTimeout Duration
+	// DisableAdaptiveHeartbeat makes the monitor check every peer at
+	// <HeartbeatInterval> no matter how it behaves.
+	DisableAdaptiveHeartbeat bool
+	// HeartbeatMinInterval is how often a peer that missed a heartbeat is
+	// checked until it answers again or is down.
+	HeartbeatMinInterval Duration
+	// HeartbeatMaxInterval is the longest interval a stable peer is
+	// slowed down to.
+	HeartbeatMaxInterval Duration
+	// HeartbeatMaxBackoff is the longest interval a peer that is down is
+	// backed off to.
+	HeartbeatMaxBackoff Duration
+	// HeartbeatStableAfter is the number of answered heartbeats in a row
+	// after which a peer is stable and checked less often.
+	HeartbeatStableAfter int
+	// SuspectAfter is the number of missed heartbeats in a row after which
+	// a peer is suspected to be down.
+	SuspectAfter int
+	// DownAfter is the number of missed heartbeats in a row after which a
+	// peer is considered down.
+	DownAfter int
+	// MonitoredPeers are the IPFS addresses of the peers the heartbeat
+	// monitor starts with.
+	MonitoredPeers []string
+	// LatencyWindow is the number of round trip times per peer that the
+	// latency statistics are computed over.
+	LatencyWindow int
+	// PhiSuspectThreshold is the phi value at which the failure detector
+	// suspects a peer.
+	PhiSuspectThreshold float64
+	// PhiFailThreshold is the phi value at which the failure detector
+	// considers a peer failed.
+	PhiFailThreshold float64
+	// PhiWindow is the number of heartbeat intervals per peer the failure
+	// detector learns from.
+	PhiWindow int
+	// PhiMinStdDev is the smallest standard deviation the failure detector
+	// assumes, so that very regular peers are not suspected after a tiny
+	// delay.
+	PhiMinStdDev Duration
+	// PhiAcceptablePause is extra time a heartbeat can be late before phi
+	// starts to grow, for example to allow for garbage collection pauses.
+	PhiAcceptablePause Duration
+	// ProbeInterval is how often the cluster membership probes a member.
+	ProbeInterval Duration
+	// ProbeTimeout is how long a member has to answer a probe.
+	ProbeTimeout Duration
+	// IndirectProbes is the number of members that are asked to probe a
+	// member that did not answer.
+	IndirectProbes int
+	// SuspicionTimeout is how long a member can stay suspect before it is
+	// declared dead.
+	SuspicionTimeout Duration
+	// HeartbeatMaxMessageSize is the largest heartbeat message in bytes the
+	// node reads from a peer.
+	HeartbeatMaxMessageSize int
+	// HeartbeatRate is how many heartbeats per second a peer can send us
+	// on average.
+	HeartbeatRate float64
+	// HeartbeatBurst is how many heartbeats a peer can send at once before
+	// <HeartbeatRate> applies.
+	HeartbeatBurst int
+	// HeartbeatMaxStreams is how many heartbeat streams the node serves at
+	// the same time.
+	HeartbeatMaxStreams int
+	// HistoryFile is the file every heartbeat result is appended to. When
+	// it is empty no history is kept.
+	HistoryFile string
+	// HistoryRetention is how long heartbeat results are kept in the
+	// history. When it is 0 they are kept forever.
+	HistoryRetention Duration
+	// HealthAddress is the TCP address of the local HTTP health server,
+	// such as <"127.0.0.1:8080">. When it is empty there is no server.
+	HealthAddress string
+	// Presence starts the pubsub presence mode when the node starts.
+	Presence bool
+	// PresenceTopic is the pubsub topic presence heartbeats are published
+	// to. Only nodes on the same topic see each other.
+	PresenceTopic string
+	// PresenceInterval is how often the node publishes a presence
+	// heartbeat.
+	PresenceInterval Duration
+	// PresenceMaxInterval is the longest interval another node can announce
+	// in its presence heartbeats. Heartbeats that announce a longer one are
+	// dropped, so a node cannot stay up for hours with a single heartbeat.
+	PresenceMaxInterval Duration
+	// LedgerFile is the database the balance with every peer is kept in.
+	// When it is empty no ledger is kept and payments are not limited.
+	LedgerFile string
+	// Assets are the codes of the assets the node accepts and the number of
+	// decimals of each, for example 2 for cents.
+	Assets map[string]int
+	// DefaultAsset is the asset of amounts that are given without a code.
+	DefaultAsset string
+	// CreditLimits is how much we can owe a peer or a peer can owe us per
+	// asset, as a decimal number such as <"1000.00">. Payments in an
+	// asset without a limit are refused.
+	CreditLimits map[string]string
+	// ReceiptsDirectory is where the signed receipts of our payments are
+	// kept as proofs of payment. When it is empty they are only checked.
+	ReceiptsDirectory string
+	// ChannelDepositLimits is the largest deposit, per asset, another node
+	// can ask us to lock in a payment channel it opens, as a decimal
+	// number such as <"100.00">. Channels that ask for more, or for a
+	// deposit in an asset without a limit, are refused.
+	ChannelDepositLimits map[string]string
+}
+
+// Duration is a <time.Duration> that is written as a string such as
+// <"5s"> or <"1m30s"> in the config file.
+type Duration struct {
+	time.Duration
+}
+
+// MarshalJSON writes <duration> as a string
+func (duration Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(duration.String())
+}
+
+// UnmarshalJSON reads <duration> from a string such as <"5s">
+func (duration *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	err := json.Unmarshal(data, &text)
+	if err != nil {
+		return err
+	}
+	duration.Duration, err = time.ParseDuration(text)
+	return err
+}
+
+// DefaultConfig returns a pointer to a <Config> struct filled with the
+// default settings.
+func DefaultConfig() *Config {
+	return &Config{
+		ACLFile:                 aclFile,
+		RelayMaxDuration:        Duration{10 * time.Minute},
+		RelayMaxData:            64 << 20,
+		HeartbeatInterval:       Duration{5 * time.Second},
+		HeartbeatTimeout:        Duration{3 * time.Second},
+		HeartbeatMinInterval:    Duration{time.Second},
+		HeartbeatMaxInterval:    Duration{30 * time.Second},
+		HeartbeatMaxBackoff:     Duration{5 * time.Minute},
+		HeartbeatStableAfter:    10,
+		SuspectAfter:            1,
+		DownAfter:               3,
+		LatencyWindow:           32,
+		PhiSuspectThreshold:     5,
+		PhiFailThreshold:        8,
+		PhiWindow:               100,
+		PhiMinStdDev:            Duration{100 * time.Millisecond},
+		ProbeInterval:           Duration{time.Second},
+		ProbeTimeout:            Duration{500 * time.Millisecond},
+		IndirectProbes:          3,
+		SuspicionTimeout:        Duration{5 * time.Second},
+		HeartbeatMaxMessageSize: 64 * 1024,
+		HeartbeatRate:           5,
+		HeartbeatBurst:          20,
+		HeartbeatMaxStreams:     64,
+		HistoryFile:             "heartbeats.log",
+		HistoryRetention:        Duration{30 * 24 * time.Hour},
+		PresenceTopic:           defaultPresenceTopic,
+		PresenceInterval:        Duration{5 * time.Second},
+		PresenceMaxInterval:     Duration{30 * time.Second},
+		LedgerFile:              "ledger.db",
+		Assets:                  map[string]int{"USD": 2, "EUR": 2, "JPY": 0, "BTC": 8},
+		DefaultAsset:            "USD",
+		CreditLimits:            map[string]string{"USD": "1000", "EUR": "1000", "JPY": "100000", "BTC": "0.1"},
+		ReceiptsDirectory:       "receipts",
+	}
+}
+
+// LoadConfig reads the settings of a node from a JSON file.
+// ----------------------------------------------------------------------------
+// <path> is a parameter of string type that is the config file. If the file
+// does not exist, the default settings are used.
+// ----------------------------------------------------------------------------
+// it returns a pointer to <Config> struct
+// It returns an error in case the file cannot be read or parsed, or holds
+// a setting that is not valid.
+func LoadConfig(path string) (*Config, error) {
+	config := DefaultConfig()
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Unmarshalling on top of the defaults keeps the default value of every
+	// field that is not in the file. Maps would be merged with the defaults
+	// though, so they are cleared first and only get the defaults back when
+	// the file does not set them.
+	assets, creditLimits := config.Assets, config.CreditLimits
+	config.Assets, config.CreditLimits = nil, nil
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return nil, err
+	}
+	if config.Assets == nil {
+		config.Assets = assets
+	}
+	if config.CreditLimits == nil {
+		config.CreditLimits = creditLimits
+	}
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate checks the settings that would break the node at run time.
+// Intervals and timeouts have to be positive, since they end up in tickers
+// and timers, and the other durations cannot be negative. Window sizes and
+// counts have to be positive, and a peer has to be suspect before it is
+// down.
+// ----------------------------------------------------------------------------
+// It returns an error that names the first setting that is not valid.
+func (config *Config) Validate() error {
+	positive := []struct {
+		name     string
+		duration Duration
+	}{
+		{"HeartbeatInterval", config.HeartbeatInterval},
+		{"HeartbeatTimeout", config.HeartbeatTimeout},
+		{"HeartbeatMinInterval", config.HeartbeatMinInterval},
+		{"HeartbeatMaxInterval", config.HeartbeatMaxInterval},
+		{"HeartbeatMaxBackoff", config.HeartbeatMaxBackoff},
+		{"ProbeInterval", config.ProbeInterval},
+		{"ProbeTimeout", config.ProbeTimeout},
+		{"SuspicionTimeout", config.SuspicionTimeout},
+		{"PresenceInterval", config.PresenceInterval},
+		{"PresenceMaxInterval", config.PresenceMaxInterval},
+		{"RelayMaxDuration", config.RelayMaxDuration},
+	}
+	for _, setting := range positive {
+		if setting.duration.Duration <= 0 {
+			return fmt.Errorf("config: %s has to be positive, not %s", setting.name, setting.duration)
+		}
+	}
+	positiveCount := []struct {
+		name  string
+		count int64
+	}{
+		{"SuspectAfter", int64(config.SuspectAfter)},
+		{"LatencyWindow", int64(config.LatencyWindow)},
+		{"PhiWindow", int64(config.PhiWindow)},
+		{"IndirectProbes", int64(config.IndirectProbes)},
+		{"HeartbeatMaxStreams", int64(config.HeartbeatMaxStreams)},
+		{"RelayMaxData", config.RelayMaxData},
+	}
+	for _, setting := range positiveCount {
+		if setting.count <= 0 {
+			return fmt.Errorf("config: %s has to be positive, not %d", setting.name, setting.count)
+		}
+	}
+	if config.SuspectAfter >= config.DownAfter {
+		return fmt.Errorf("config: SuspectAfter (%d) has to be less than DownAfter (%d)", config.SuspectAfter, config.DownAfter)
+	}
+	notNegative := []struct {
+		name     string
+		duration Duration
+	}{
+		{"PhiMinStdDev", config.PhiMinStdDev},
+		{"PhiAcceptablePause", config.PhiAcceptablePause},
+		{"HistoryRetention", config.HistoryRetention},
+	}
+	for _, setting := range notNegative {
+		if setting.duration.Duration < 0 {
+			return fmt.Errorf("config: %s cannot be negative, not %s", setting.name, setting.duration)
+		}
+	}
+	return nil
+}
+
+// GeneratePrivateNetworkKey creates a new random 32 byte pre-shared key and
+// writes it to <path> in the format that libp2p's private network expects.
+// Every node of the private network needs a copy of this file.
+// ----------------------------------------------------------------------------
+// It returns an error in case something goes wrong.
+func GeneratePrivateNetworkKey(path string) error {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return err
+	}
+	content := fmt.Sprintf("/key/swarm/psk/1.0.0/\n/base16/\n%s\n", hex.EncodeToString(key))
+	// The key is a secret, so only the owner can read it.
+	return ioutil.WriteFile(path, []byte(content), 0600)
+}
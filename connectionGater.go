@@ -0,0 +1,377 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+
+	control "github.com/libp2p/go-libp2p-core/control"
+	network "github.com/libp2p/go-libp2p-core/network"
+	peer "github.com/libp2p/go-libp2p-peer"
+	multiaddr "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// aclFile is the file that the access control lists of a node are
+// saved to and loaded from.
+const aclFile = "acl.json"
+
+// AccessControlList is a struct that holds the rules a node uses to decide
+// who can connect to it and which protocols they can use.
+// <AllowPeers> and <AllowCIDRs> are only enforced when they are not empty,
+// and a denied peer or address is always rejected, even if it is also allowed.
+// <Protocols> maps a protocol (for example <"/sync/1.0.0">) to the peers
+// that are allowed to open it. protocols that are not in the map are open to
+// every peer that got past the gater.
+type AccessControlList struct {
+	AllowPeers []string
+	DenyPeers  []string
+	AllowCIDRs []string
+	DenyCIDRs  []string
+	Protocols  map[string][]string
+}
+
+// ConnectionGater is a struct that wraps an <AccessControlList> and
+// implements libp2p's <connmgr.ConnectionGater> interface, so that the
+// swarm asks it before dialing or accepting any connection.
+type ConnectionGater struct {
+	mutex     sync.RWMutex
+	path      string
+	acl       AccessControlList
+	allowNets []*net.IPNet
+	denyNets  []*net.IPNet
+}
+
+// LoadConnectionGater reads the access control lists from disk and creates
+// a <ConnectionGater> from them.
+// ----------------------------------------------------------------------------
+// <path> is a parameter of string type that is the file the lists are stored
+// in. If the file does not exist yet, an empty (allow all) gater is returned
+// and the file is created the first time a rule is changed.
+// ----------------------------------------------------------------------------
+// it returns a pointer to <ConnectionGater> struct
+// It returns an error in case the file cannot be read or parsed.
+func LoadConnectionGater(path string) (*ConnectionGater, error) {
+	gater := &ConnectionGater{
+		path: path,
+		acl:  AccessControlList{Protocols: make(map[string][]string)},
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return gater, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &gater.acl)
+	if err != nil {
+		return nil, err
+	}
+	if gater.acl.Protocols == nil {
+		gater.acl.Protocols = make(map[string][]string)
+	}
+	// CIDR strings are parsed once here so that every connection attempt
+	// does not have to parse them again.
+	err = gater.compile()
+	if err != nil {
+		return nil, err
+	}
+	return gater, nil
+}
+
+// compile turns the CIDR strings of the access control list into
+// <net.IPNet> values. It must be called with the lock held.
+func (gater *ConnectionGater) compile() error {
+	allowNets, err := parseCIDRs(gater.acl.AllowCIDRs)
+	if err != nil {
+		return err
+	}
+	denyNets, err := parseCIDRs(gater.acl.DenyCIDRs)
+	if err != nil {
+		return err
+	}
+	gater.allowNets = allowNets
+	gater.denyNets = denyNets
+	return nil
+}
+
+// parseCIDRs parses a list of CIDR strings such as <"10.0.0.0/8">
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, ipNet)
+	}
+	return result, nil
+}
+
+// save writes the access control list to disk as indented JSON.
+// It must be called with the lock held.
+func (gater *ConnectionGater) save() error {
+	data, err := json.MarshalIndent(gater.acl, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(gater.path, data, 0644)
+}
+
+// update applies <change> to the access control list, then re-parses the
+// CIDR ranges and saves the result to disk. If anything fails, the old list
+// is kept.
+func (gater *ConnectionGater) update(change func(acl *AccessControlList)) error {
+	gater.mutex.Lock()
+	defer gater.mutex.Unlock()
+	old := gater.acl
+	oldProtocols := make(map[string][]string)
+	for protocol, peers := range gater.acl.Protocols {
+		oldProtocols[protocol] = append([]string(nil), peers...)
+	}
+	change(&gater.acl)
+	err := gater.compile()
+	if err == nil {
+		err = gater.save()
+	}
+	if err != nil {
+		old.Protocols = oldProtocols
+		gater.acl = old
+		gater.compile()
+	}
+	return err
+}
+
+// AllowPeer adds <id> to the peer allowlist.
+func (gater *ConnectionGater) AllowPeer(id peer.ID) error {
+	return gater.update(func(acl *AccessControlList) {
+		acl.AllowPeers = appendUnique(acl.AllowPeers, id.Pretty())
+	})
+}
+
+// DenyPeer adds <id> to the peer denylist.
+func (gater *ConnectionGater) DenyPeer(id peer.ID) error {
+	return gater.update(func(acl *AccessControlList) {
+		acl.DenyPeers = appendUnique(acl.DenyPeers, id.Pretty())
+	})
+}
+
+// AllowCIDR adds the <cidr> range (for example <"192.168.0.0/16">) to the
+// address allowlist.
+func (gater *ConnectionGater) AllowCIDR(cidr string) error {
+	return gater.update(func(acl *AccessControlList) {
+		acl.AllowCIDRs = appendUnique(acl.AllowCIDRs, cidr)
+	})
+}
+
+// DenyCIDR adds the <cidr> range to the address denylist.
+func (gater *ConnectionGater) DenyCIDR(cidr string) error {
+	return gater.update(func(acl *AccessControlList) {
+		acl.DenyCIDRs = appendUnique(acl.DenyCIDRs, cidr)
+	})
+}
+
+// RestrictProtocol allows <id> to open <protocol>. As soon as a protocol has
+// one allowed peer, every peer that is not listed is refused.
+func (gater *ConnectionGater) RestrictProtocol(protocol string, id peer.ID) error {
+	return gater.update(func(acl *AccessControlList) {
+		acl.Protocols[protocol] = appendUnique(acl.Protocols[protocol], id.Pretty())
+	})
+}
+
+// OpenProtocol removes every rule of <protocol> so that it is open again.
+func (gater *ConnectionGater) OpenProtocol(protocol string) error {
+	return gater.update(func(acl *AccessControlList) {
+		delete(acl.Protocols, protocol)
+	})
+}
+
+// Remove deletes <entry> (a peer ID or a CIDR range) from every list it is in.
+func (gater *ConnectionGater) Remove(entry string) error {
+	return gater.update(func(acl *AccessControlList) {
+		acl.AllowPeers = removeString(acl.AllowPeers, entry)
+		acl.DenyPeers = removeString(acl.DenyPeers, entry)
+		acl.AllowCIDRs = removeString(acl.AllowCIDRs, entry)
+		acl.DenyCIDRs = removeString(acl.DenyCIDRs, entry)
+		for protocol, peers := range acl.Protocols {
+			acl.Protocols[protocol] = removeString(peers, entry)
+			if len(acl.Protocols[protocol]) == 0 {
+				delete(acl.Protocols, protocol)
+			}
+		}
+	})
+}
+
+// String returns the access control list as indented JSON so that it can be
+// shown in the shell.
+func (gater *ConnectionGater) String() string {
+	gater.mutex.RLock()
+	defer gater.mutex.RUnlock()
+	data, _ := json.MarshalIndent(gater.acl, "", "  ")
+	return string(data)
+}
+
+// peerAllowed checks <id> against the peer lists.
+func (gater *ConnectionGater) peerAllowed(id peer.ID) bool {
+	gater.mutex.RLock()
+	defer gater.mutex.RUnlock()
+	if containsString(gater.acl.DenyPeers, id.Pretty()) {
+		return false
+	}
+	if len(gater.acl.AllowPeers) == 0 {
+		return true
+	}
+	return containsString(gater.acl.AllowPeers, id.Pretty())
+}
+
+// addrAllowed checks the IP address of <address> against the CIDR lists.
+// Addresses that have no IP part (for example relay addresses) are only
+// checked against the peer lists.
+func (gater *ConnectionGater) addrAllowed(address multiaddr.Multiaddr) bool {
+	ip, err := manet.ToIP(address)
+	if err != nil {
+		return true
+	}
+	gater.mutex.RLock()
+	defer gater.mutex.RUnlock()
+	for _, ipNet := range gater.denyNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if len(gater.allowNets) == 0 {
+		return true
+	}
+	for _, ipNet := range gater.allowNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ProtocolAllowed checks whether <id> may open a stream of <protocol>.
+func (gater *ConnectionGater) ProtocolAllowed(protocol string, id peer.ID) bool {
+	if !gater.peerAllowed(id) {
+		return false
+	}
+	gater.mutex.RLock()
+	defer gater.mutex.RUnlock()
+	peers, restricted := gater.acl.Protocols[protocol]
+	if !restricted {
+		return true
+	}
+	return containsString(peers, id.Pretty())
+}
+
+// InterceptPeerDial is called by the swarm before it dials <id>.
+func (gater *ConnectionGater) InterceptPeerDial(id peer.ID) bool {
+	return gater.peerAllowed(id)
+}
+
+// InterceptAddrDial is called by the swarm before it dials <address> of <id>.
+func (gater *ConnectionGater) InterceptAddrDial(id peer.ID, address multiaddr.Multiaddr) bool {
+	return gater.addrAllowed(address)
+}
+
+// InterceptAccept is called as soon as a remote node opens a connection to
+// us, before we know its peer ID.
+func (gater *ConnectionGater) InterceptAccept(addresses network.ConnMultiaddrs) bool {
+	return gater.addrAllowed(addresses.RemoteMultiaddr())
+}
+
+// InterceptSecured is called after the security handshake, when the peer ID
+// of the remote node is known.
+func (gater *ConnectionGater) InterceptSecured(direction network.Direction, id peer.ID, addresses network.ConnMultiaddrs) bool {
+	return gater.peerAllowed(id) && gater.addrAllowed(addresses.RemoteMultiaddr())
+}
+
+// InterceptUpgraded is called once the connection is fully set up. All the
+// checks are already done in the previous steps.
+func (gater *ConnectionGater) InterceptUpgraded(conn network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+// enforceAccessControl closes every open connection that the current access
+// control lists would not accept anymore. It is called after rules change.
+// ----------------------------------------------------------------------------
+// <node> is a receiver of pointer to struct type PeerNode
+func (node *PeerNode) enforceAccessControl() {
+	for _, conn := range node.Network().Conns() {
+		if !node.gater.InterceptSecured(conn.Stat().Direction, conn.RemotePeer(), conn) {
+			fmt.Printf("Closing connection to %s\n", conn.RemotePeer())
+			conn.Close()
+		}
+	}
+}
+
+// streamAllowed is called at the start of every stream handler to check the
+// per-protocol rules.
+// ----------------------------------------------------------------------------
+// <protocol> is the protocol the stream was opened with and <remote> is the
+// peer that opened it.
+// ----------------------------------------------------------------------------
+// it returns false if the stream should get reset
+func (node *PeerNode) streamAllowed(protocol string, remote peer.ID) bool {
+	if node.gater.ProtocolAllowed(protocol, remote) {
+		return true
+	}
+	fmt.Printf("Access denied: %s is not allowed to use %s\n", remote, protocol)
+	return false
+}
+
+// appendUnique appends <value> to <list> if it is not in it already
+func appendUnique(list []string, value string) []string {
+	if containsString(list, value) {
+		return list
+	}
+	return append(list, value)
+}
+
+// removeString returns <list> without <value>
+func removeString(list []string, value string) []string {
+	var result []string
+	for _, item := range list {
+		if item != value {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// containsString checks if <value> is in <list>
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,367 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// failureDetectorQueue is how many level changes can wait for the callbacks.
+// Changes that do not fit are dropped and counted.
+const failureDetectorQueue = 256
+
+// failureDetectorTick is how often the failure detector re-computes the
+// suspicion level of every peer. Phi grows while no heartbeat arrives, so it
+// has to be checked even when nothing happens.
+const failureDetectorTick = time.Second
+
+// SuspicionLevel is how sure the failure detector is that a peer failed
+type SuspicionLevel int
+
+const (
+	// Healthy means phi is below the suspect threshold
+	Healthy SuspicionLevel = iota
+	// Suspected means phi reached the suspect threshold
+	Suspected
+	// Failed means phi reached the fail threshold
+	Failed
+)
+
+// String returns the name of <level> as it is shown in the shell
+func (level SuspicionLevel) String() string {
+	switch level {
+	case Suspected:
+		return "suspected"
+	case Failed:
+		return "failed"
+	default:
+		return "healthy"
+	}
+}
+
+// SuspicionEvent is the value that is passed to the callbacks of the failure
+// detector every time the suspicion level of a peer changes.
+type SuspicionEvent struct {
+	Peer     peer.ID
+	Previous SuspicionLevel
+	Level    SuspicionLevel
+	Phi      float64
+	Time     time.Time
+}
+
+// String returns <event> as a line that can be shown in the shell
+func (event SuspicionEvent) String() string {
+	return fmt.Sprintf("%s %s: %s -> %s (phi=%.2f)", event.Time.Format("15:04:05"), event.Peer, event.Previous, event.Level, event.Phi)
+}
+
+// arrivalWindow is a struct that holds the last intervals between the
+// heartbeats of one peer. <expected> is the interval the heartbeat monitor
+// plans to wait before the next heartbeat, 0 if it did not say.
+type arrivalWindow struct {
+	lastArrival time.Time
+	intervals   []time.Duration
+	expected    time.Duration
+	level       SuspicionLevel
+}
+
+// FailureDetector is a phi-accrual failure detector. Instead of calling a
+// peer dead after a fixed timeout, it learns how far apart the heartbeats of
+// every peer usually are and computes phi, a suspicion value that grows the
+// longer the next heartbeat is late compared to that history.
+// phi = 1 means a 10% chance that the peer is still alive and only late,
+// phi = 2 means 1%, phi = 3 means 0.1% and so on.
+type FailureDetector struct {
+	window           int
+	minStdDev        time.Duration
+	acceptablePause  time.Duration
+	firstEstimate    time.Duration
+	suspectThreshold float64
+	failThreshold    float64
+
+	mutex     sync.RWMutex
+	peers     map[peer.ID]*arrivalWindow
+	callbacks []func(SuspicionEvent)
+	started   bool
+	// events holds the level changes for the goroutine that calls the
+	// callbacks. <dropped> counts the changes that did not fit and
+	// <unreported> the ones that were not logged yet, both are only used
+	// through <sync/atomic>.
+	events     chan SuspicionEvent
+	dropped    uint64
+	unreported uint64
+	// context stops the goroutines of the detector
+	context context.Context
+}
+
+// NewFailureDetector creates a <FailureDetector> with the thresholds and
+// window of <config>. It starts checking peers as soon as the first
+// heartbeat arrives, and stops when <ctx> is done.
+func NewFailureDetector(ctx context.Context, config *Config) *FailureDetector {
+	return &FailureDetector{
+		context:          ctx,
+		window:           config.PhiWindow,
+		minStdDev:        config.PhiMinStdDev.Duration,
+		acceptablePause:  config.PhiAcceptablePause.Duration,
+		firstEstimate:    config.HeartbeatInterval.Duration,
+		suspectThreshold: config.PhiSuspectThreshold,
+		failThreshold:    config.PhiFailThreshold,
+		peers:            make(map[peer.ID]*arrivalWindow),
+		events:           make(chan SuspicionEvent, failureDetectorQueue),
+	}
+}
+
+// SetThresholds changes the phi values at which peers become suspected and
+// failed.
+func (detector *FailureDetector) SetThresholds(suspect float64, fail float64) {
+	detector.mutex.Lock()
+	defer detector.mutex.Unlock()
+	detector.suspectThreshold = suspect
+	detector.failThreshold = fail
+}
+
+// OnChange registers <callback> to be called every time the suspicion level
+// of a peer changes. Callbacks are called one after the other, in the order
+// of the changes, from a goroutine of the detector. A callback that blocks
+// holds up the callbacks after it, not the heartbeats: once
+// <failureDetectorQueue> changes are waiting, new ones are dropped and
+// counted in <Dropped>.
+// Only the heartbeats of the heartbeat monitor feed the detector, so peers
+// that are not monitored are never reported.
+func (detector *FailureDetector) OnChange(callback func(SuspicionEvent)) {
+	detector.mutex.Lock()
+	defer detector.mutex.Unlock()
+	detector.callbacks = append(detector.callbacks, callback)
+}
+
+// Heartbeat records that a heartbeat of <peerID> arrived at <arrival>.
+// <expected> is how long the sender waits before the next heartbeat. When
+// it changes, like when the adaptive heartbeat slows down a stable peer,
+// the intervals learned so far are dropped and <expected> is used until
+// there are new ones, so a slower pace is not taken for a failure.
+// <expected> can be 0 when the pace is unknown.
+func (detector *FailureDetector) Heartbeat(peerID peer.ID, arrival time.Time, expected time.Duration) {
+	detector.mutex.Lock()
+	history, ok := detector.peers[peerID]
+	if !ok {
+		history = &arrivalWindow{}
+		detector.peers[peerID] = history
+	}
+	if !history.lastArrival.IsZero() {
+		history.intervals = append(history.intervals, arrival.Sub(history.lastArrival))
+		if len(history.intervals) > detector.window {
+			history.intervals = history.intervals[len(history.intervals)-detector.window:]
+		}
+	}
+	if expected != history.expected {
+		history.intervals = nil
+		history.expected = expected
+	}
+	history.lastArrival = arrival
+	start := !detector.started
+	detector.started = true
+	detector.mutex.Unlock()
+	if start {
+		go detector.run()
+		go detector.dispatch()
+	}
+	// a heartbeat can bring a peer back, which is reported right away
+	detector.evaluate(time.Now())
+}
+
+// Forget removes everything the detector knows about <peerID>
+func (detector *FailureDetector) Forget(peerID peer.ID) {
+	detector.mutex.Lock()
+	defer detector.mutex.Unlock()
+	delete(detector.peers, peerID)
+}
+
+// Phi returns the current suspicion value of <peerID>. It returns 0 for
+// peers that never sent a heartbeat.
+func (detector *FailureDetector) Phi(peerID peer.ID) float64 {
+	detector.mutex.RLock()
+	defer detector.mutex.RUnlock()
+	history, ok := detector.peers[peerID]
+	if !ok {
+		return 0
+	}
+	return detector.phi(history, time.Now())
+}
+
+// Level returns the current suspicion level of <peerID>
+func (detector *FailureDetector) Level(peerID peer.ID) SuspicionLevel {
+	phi := detector.Phi(peerID)
+	detector.mutex.RLock()
+	defer detector.mutex.RUnlock()
+	return detector.level(phi)
+}
+
+// level turns a phi value into a suspicion level. It must be called with
+// the lock held.
+func (detector *FailureDetector) level(phi float64) SuspicionLevel {
+	switch {
+	case phi >= detector.failThreshold:
+		return Failed
+	case phi >= detector.suspectThreshold:
+		return Suspected
+	default:
+		return Healthy
+	}
+}
+
+// phi computes the suspicion value of <history> at <now>. The intervals are
+// assumed to be normally distributed, and phi is minus the base 10 logarithm
+// of the probability that the next heartbeat arrives even later than now.
+// The logistic approximation of the normal distribution is the one Akka and
+// Cassandra use. It must be called with the lock held.
+func (detector *FailureDetector) phi(history *arrivalWindow, now time.Time) float64 {
+	// until there is a history, the interval the monitor announced is used
+	// as the expected interval
+	mean := float64(detector.firstEstimate)
+	if history.expected > 0 {
+		mean = float64(history.expected)
+	}
+	stdDev := mean / 4
+	if len(history.intervals) > 0 {
+		var sum float64
+		for _, interval := range history.intervals {
+			sum += float64(interval)
+		}
+		mean = sum / float64(len(history.intervals))
+		var variance float64
+		for _, interval := range history.intervals {
+			variance += (float64(interval) - mean) * (float64(interval) - mean)
+		}
+		stdDev = math.Sqrt(variance / float64(len(history.intervals)))
+	}
+	if stdDev < float64(detector.minStdDev) {
+		stdDev = float64(detector.minStdDev)
+	}
+	if stdDev <= 0 {
+		stdDev = 1
+	}
+	mean += float64(detector.acceptablePause)
+	elapsed := float64(now.Sub(history.lastArrival))
+	y := (elapsed - mean) / stdDev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if elapsed > mean {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
+
+// run re-computes the suspicion levels every <failureDetectorTick> until
+// the context of the detector is done
+func (detector *FailureDetector) run() {
+	ticker := time.NewTicker(failureDetectorTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-detector.context.Done():
+			return
+		case now := <-ticker.C:
+			detector.evaluate(now)
+		}
+	}
+}
+
+// evaluate re-computes the suspicion level of every peer and calls the
+// callbacks for the levels that changed.
+func (detector *FailureDetector) evaluate(now time.Time) {
+	var events []SuspicionEvent
+	detector.mutex.Lock()
+	for peerID, history := range detector.peers {
+		phi := detector.phi(history, now)
+		level := detector.level(phi)
+		if level == history.level {
+			continue
+		}
+		events = append(events, SuspicionEvent{
+			Peer:     peerID,
+			Previous: history.level,
+			Level:    level,
+			Phi:      phi,
+			Time:     now,
+		})
+		history.level = level
+	}
+	detector.mutex.Unlock()
+	// the callbacks run in <dispatch>, so neither the caller of <Heartbeat>
+	// nor the ticker waits for them. When the callbacks fall behind, the
+	// change is dropped instead.
+	for _, event := range events {
+		select {
+		case detector.events <- event:
+		default:
+			atomic.AddUint64(&detector.dropped, 1)
+			atomic.AddUint64(&detector.unreported, 1)
+		}
+	}
+}
+
+// Dropped returns how many level changes were dropped because the callbacks
+// fell behind
+func (detector *FailureDetector) Dropped() uint64 {
+	return atomic.LoadUint64(&detector.dropped)
+}
+
+// dispatch calls the callbacks for every level change until the context of
+// the detector is done. They are called without the lock so that they can
+// use the detector themselves. Dropped changes are reported once the
+// callbacks caught up.
+func (detector *FailureDetector) dispatch() {
+	for {
+		var event SuspicionEvent
+		select {
+		case <-detector.context.Done():
+			return
+		case event = <-detector.events:
+		}
+		if dropped := atomic.SwapUint64(&detector.unreported, 0); dropped > 0 {
+			fmt.Printf("Failure Detector: %d level changes were dropped, the callbacks are too slow\n", dropped)
+		}
+		detector.mutex.RLock()
+		callbacks := make([]func(SuspicionEvent), len(detector.callbacks))
+		copy(callbacks, detector.callbacks)
+		detector.mutex.RUnlock()
+		for _, callback := range callbacks {
+			callback(event)
+		}
+	}
+}
+
+// FailureDetector returns the phi-accrual failure detector of <node>. It is
+// fed by every heartbeat of the heartbeat monitor that gets an answer, so
+// services can register callbacks on it and react when a monitored peer
+// fails.
+func (node *PeerNode) FailureDetector() *FailureDetector {
+	return node.detector
+}
@@ -0,0 +1,189 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// healthShutdownTimeout is how long the health server waits for running
+// requests when the node is closed
+const healthShutdownTimeout = 5 * time.Second
+
+// NodeHealth is what </healthz> answers with. <Uptime> is in seconds.
+type NodeHealth struct {
+	Status      string
+	Peer        string
+	Uptime      int64
+	Connections int
+}
+
+// PeerHealth is the monitor's view of one peer as </peers/health> shows
+// it. <LastSeen> is null when the peer never answered and <Latency> when
+// there are no round trip times yet.
+type PeerHealth struct {
+	Peer          string
+	Address       string
+	State         string
+	Authenticated bool
+	LastSeen      *time.Time
+	LastChecked   *time.Time
+	Failures      int
+	Successes     int
+	LastError     string
+	Interval      Duration
+	Latency       *LatencyHealth
+}
+
+// LatencyHealth holds the round trip time statistics of a peer in
+// </peers/health>
+type LatencyHealth struct {
+	Samples int
+	Min     Duration
+	Avg     Duration
+	P95     Duration
+	Max     Duration
+	Jitter  Duration
+}
+
+// StartHealthServer serves the health of <node> over plain HTTP, so that
+// tools that do not speak libp2p, like container orchestrators and load
+// balancers, can check it:
+// - </healthz> answers 200 as long as the node runs;
+// - </peers/health> answers with a JSON list of every monitored peer.
+// ----------------------------------------------------------------------------
+// <address> is a parameter of string type that is the TCP address to listen
+// on, such as <"127.0.0.1:8080">.
+// ----------------------------------------------------------------------------
+// it returns the address the server listens on, which has the real port
+// when <address> asks for port 0.
+// It returns an error in case <address> cannot be listened on.
+// The server is shut down when <node> is closed.
+func (node *PeerNode) StartHealthServer(address string) (string, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return "", err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", node.handleHealthz)
+	mux.HandleFunc("/peers/health", node.handlePeersHealth)
+	server := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+	}
+	node.healthServer = server
+	go func() {
+		err := server.Serve(listener)
+		if err != http.ErrServerClosed {
+			fmt.Println("Health Server:", err)
+		}
+	}()
+	// requests that are running get <healthShutdownTimeout> to finish
+	go func() {
+		<-node.context.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), healthShutdownTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	return listener.Addr().String(), nil
+}
+
+// handleHealthz answers </healthz>. A node that can answer is up.
+func (node *PeerNode) handleHealthz(writer http.ResponseWriter, request *http.Request) {
+	health := NodeHealth{
+		Status:      "ok",
+		Peer:        peer.IDB58Encode(node.ID()),
+		Uptime:      int64(time.Since(node.started) / time.Second),
+		Connections: len(node.Network().Conns()),
+	}
+	writeHealthJSON(writer, request, health)
+}
+
+// handlePeersHealth answers </peers/health> with the snapshot of the
+// heartbeat monitor and the latency statistics of every peer.
+func (node *PeerNode) handlePeersHealth(writer http.ResponseWriter, request *http.Request) {
+	result := []PeerHealth{}
+	for _, status := range node.Monitor().Snapshot() {
+		health := PeerHealth{
+			Peer:          peer.IDB58Encode(status.Peer),
+			Address:       status.Address,
+			State:         status.State.String(),
+			Authenticated: status.Authenticated,
+			Failures:      status.Failures,
+			Successes:     status.Successes,
+			LastError:     status.LastError,
+			Interval:      Duration{status.Interval},
+		}
+		if !status.LastSeen.IsZero() {
+			lastSeen := status.LastSeen
+			health.LastSeen = &lastSeen
+		}
+		if !status.LastChecked.IsZero() {
+			lastChecked := status.LastChecked
+			health.LastChecked = &lastChecked
+		}
+		if stats, ok := node.LatencyStats(status.Peer); ok {
+			health.Latency = &LatencyHealth{
+				Samples: stats.Samples,
+				Min:     Duration{stats.Min},
+				Avg:     Duration{stats.Avg},
+				P95:     Duration{stats.P95},
+				Max:     Duration{stats.Max},
+				Jitter:  Duration{stats.Jitter},
+			}
+		}
+		result = append(result, health)
+	}
+	writeHealthJSON(writer, request, result)
+}
+
+// writeHealthJSON writes <value> as the JSON answer to <request>. Only GET
+// and HEAD are answered, everything else gets 405.
+func writeHealthJSON(writer http.ResponseWriter, request *http.Request, value interface{}) {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		writer.Header().Set("Allow", "GET, HEAD")
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(http.StatusOK)
+	if request.Method == http.MethodGet {
+		writer.Write(append(data, '\n'))
+	}
+}
@@ -0,0 +1,107 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// heartbeatNonceSize is the length of the random challenge in bytes
+const heartbeatNonceSize = 32
+
+// maxHeartbeatClockSkew is how far the signed timestamp of a reply can be
+// from our own clock before the reply is refused
+const maxHeartbeatClockSkew = 5 * time.Minute
+
+// heartbeatChallengePrefix is put in front of every signed challenge, so a
+// heartbeat signature can never be mistaken for a signature of anything else
+const heartbeatChallengePrefix = "libp2p-examples heartbeat challenge:"
+
+// newHeartbeatNonce returns a random challenge for a <HeartbeatRequest>
+func newHeartbeatNonce() ([]byte, error) {
+	nonce := make([]byte, heartbeatNonceSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// heartbeatChallenge returns the bytes that are signed to answer a
+// challenge: the prefix, the <nonce> of the request and the <timestamp> of
+// the response in Unix nanoseconds.
+func heartbeatChallenge(nonce []byte, timestamp int64) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString(heartbeatChallengePrefix)
+	buffer.Write(nonce)
+	binary.Write(&buffer, binary.BigEndian, timestamp)
+	return buffer.Bytes()
+}
+
+// signHeartbeat answers the challenge in <request> by signing its nonce and
+// the timestamp of <response> with the private key of <node>.
+// ----------------------------------------------------------------------------
+// It does nothing if <request> has no nonce, so older senders still get an
+// answer.
+func (node *PeerNode) signHeartbeat(request *HeartbeatRequest, response *HeartbeatResponse) error {
+	if len(request.Nonce) == 0 {
+		return nil
+	}
+	signature, publicKey, err := node.sign(heartbeatChallenge(request.Nonce, response.Timestamp))
+	if err != nil {
+		return err
+	}
+	response.Signature = signature
+	response.PublicKey = publicKey
+	return nil
+}
+
+// verifyHeartbeat checks that <response> was signed by <peerID> for the
+// challenge in <request>.
+// ----------------------------------------------------------------------------
+// It returns an error when <response> is not signed at all, when it is
+// signed by anyone but <peerID>, the signature is wrong or the timestamp is
+// too far from our clock. Every node that speaks <"/heartbeat/2.0.0"> signs
+// its replies, so a missing signature means it was stripped on the way.
+func verifyHeartbeat(peerID peer.ID, request *HeartbeatRequest, response *HeartbeatResponse) error {
+	if len(response.Signature) == 0 {
+		return fmt.Errorf("heartbeat reply of %s is not signed", peerID)
+	}
+	err := verifySignature(peerID, heartbeatChallenge(request.Nonce, response.Timestamp), response.Signature, response.PublicKey)
+	if err != nil {
+		return fmt.Errorf("heartbeat reply: %s", err)
+	}
+	skew := time.Since(time.Unix(0, response.Timestamp))
+	if skew > maxHeartbeatClockSkew || skew < -maxHeartbeatClockSkew {
+		return fmt.Errorf("heartbeat reply of %s is signed %s away from our clock", peerID, skew)
+	}
+	return nil
+}
@@ -0,0 +1,363 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// compactionInterval is how often at most the history file is rewritten
+// without the records that are older than the retention
+const compactionInterval = time.Hour
+
+// HeartbeatRecord is one line of the heartbeat history: the outcome of one
+// heartbeat to <Peer>. <RTT> is only set when <Success> is true and <Error>
+// only when it is false.
+type HeartbeatRecord struct {
+	Peer    string
+	Time    time.Time
+	RTT     time.Duration
+	Success bool
+	// Authenticated is true when the reply was signed by the peer
+	Authenticated bool   `json:",omitempty"`
+	Error         string `json:",omitempty"`
+}
+
+// HeartbeatHistory is a struct that appends every heartbeat result to a
+// file with one JSON record per line and drops the records that are older
+// than <retention>.
+type HeartbeatHistory struct {
+	path      string
+	retention time.Duration
+
+	mutex     sync.Mutex
+	file      *os.File
+	compacted time.Time
+}
+
+// OpenHeartbeatHistory opens the heartbeat history in <path> and creates
+// the file if it does not exist yet.
+// ----------------------------------------------------------------------------
+// <path> is a parameter of string type that is the history file.
+// <retention> is a parameter of <time.Duration> type that is how long
+// records are kept. When it is 0, records are kept forever.
+// ----------------------------------------------------------------------------
+// it returns a pointer to <HeartbeatHistory> struct
+// It returns an error in case the file cannot be opened or compacted.
+func OpenHeartbeatHistory(path string, retention time.Duration) (*HeartbeatHistory, error) {
+	history := &HeartbeatHistory{path: path, retention: retention}
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	err := history.compactLocked(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// record adds the outcome of a heartbeat to <peerID> to the history. It is
+// called by <sendHeartbeat> and does nothing when there is no history.
+// A history that cannot be written is reported but does not fail the
+// heartbeat.
+func (history *HeartbeatHistory) record(peerID peer.ID, result *HeartbeatResult, err error) {
+	if history == nil {
+		return
+	}
+	record := HeartbeatRecord{Peer: peer.IDB58Encode(peerID), Time: time.Now()}
+	if err == nil {
+		record.Success = true
+		record.Time = result.Time
+		record.RTT = result.RTT
+		record.Authenticated = result.Authenticated
+	} else {
+		record.Error = err.Error()
+	}
+	if err := history.Append(record); err != nil {
+		fmt.Println("Heartbeat History:", err)
+	}
+}
+
+// Append writes <record> at the end of the history file
+func (history *HeartbeatHistory) Append(record HeartbeatRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	if now := time.Now(); now.Sub(history.compacted) > compactionInterval {
+		err = history.compactLocked(now)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = history.file.Write(append(line, '\n'))
+	return err
+}
+
+// Records returns the records of <peerID> from <since> on, oldest first
+func (history *HeartbeatHistory) Records(peerID peer.ID, since time.Time) ([]HeartbeatRecord, error) {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	target := peer.IDB58Encode(peerID)
+	var result []HeartbeatRecord
+	err := history.scanLocked(func(record HeartbeatRecord) {
+		if record.Peer == target && !record.Time.Before(since) {
+			result = append(result, record)
+		}
+	})
+	return result, err
+}
+
+// scanLocked calls <visit> for every record in the history file. Lines
+// that cannot be parsed, like a line that was cut off by a crash, are
+// skipped.
+func (history *HeartbeatHistory) scanLocked(visit func(HeartbeatRecord)) error {
+	file, err := os.Open(history.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record HeartbeatRecord
+		if json.Unmarshal(scanner.Bytes(), &record) != nil {
+			continue
+		}
+		visit(record)
+	}
+	return scanner.Err()
+}
+
+// compactLocked rewrites the history file without the records that are
+// older than the retention and opens it again for appending. The new file
+// is written next to the old one and renamed, so a crash never loses the
+// whole history. The records are copied one by one while the old file is
+// read, so the history is never loaded into memory.
+func (history *HeartbeatHistory) compactLocked(now time.Time) error {
+	if history.retention > 0 {
+		cutoff := now.Add(-history.retention)
+		temporary := history.path + ".tmp"
+		file, err := os.OpenFile(temporary, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		writer := bufio.NewWriter(file)
+		encoder := json.NewEncoder(writer)
+		var writeErr error
+		err = history.scanLocked(func(record HeartbeatRecord) {
+			if writeErr == nil && !record.Time.Before(cutoff) {
+				writeErr = encoder.Encode(record)
+			}
+		})
+		if err == nil {
+			err = writeErr
+		}
+		if err == nil {
+			err = writer.Flush()
+		}
+		if err == nil {
+			err = file.Close()
+		} else {
+			file.Close()
+		}
+		if err != nil {
+			os.Remove(temporary)
+			return err
+		}
+		err = os.Rename(temporary, history.path)
+		if err != nil {
+			return err
+		}
+	}
+	if history.file != nil {
+		history.file.Close()
+	}
+	file, err := os.OpenFile(history.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		history.file = nil
+		return err
+	}
+	history.file = file
+	history.compacted = now
+	return nil
+}
+
+// Close closes the history file
+func (history *HeartbeatHistory) Close() error {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	if history.file == nil {
+		return nil
+	}
+	err := history.file.Close()
+	history.file = nil
+	return err
+}
+
+// OutageWindow is a time span in which a peer did not answer heartbeats.
+// It starts at the first failed heartbeat and ends at the next answered
+// one. <Ongoing> is true when the peer has not answered since.
+type OutageWindow struct {
+	Start   time.Time
+	End     time.Time
+	Ongoing bool
+}
+
+// UptimeReport is a struct that holds the availability of a peer between
+// <Since> and <Until>. <Availability> is the share of that time in percent
+// that the peer was not in an outage.
+type UptimeReport struct {
+	Peer         peer.ID
+	Since        time.Time
+	Until        time.Time
+	Checks       int
+	Failures     int
+	Availability float64
+	Outages      []OutageWindow
+}
+
+// Uptime computes the availability of <peerID> from <since> until now
+// out of the heartbeat history.
+// ----------------------------------------------------------------------------
+// The report only covers the time from the first record on, so a peer
+// that was added an hour ago is not reported as down for the rest of a
+// 24 hour window.
+// ----------------------------------------------------------------------------
+// It returns an error in case there are no records of <peerID> since
+// <since>.
+func (history *HeartbeatHistory) Uptime(peerID peer.ID, since time.Time) (*UptimeReport, error) {
+	records, err := history.Records(peerID, since)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no heartbeats to %s since %s", peerID, since.Format(time.RFC3339))
+	}
+	report := &UptimeReport{
+		Peer:   peerID,
+		Since:  records[0].Time,
+		Until:  time.Now(),
+		Checks: len(records),
+	}
+	var outage *OutageWindow
+	var down time.Duration
+	for _, record := range records {
+		if !record.Success {
+			report.Failures++
+			if outage == nil {
+				outage = &OutageWindow{Start: record.Time}
+			}
+			continue
+		}
+		if outage != nil {
+			outage.End = record.Time
+			down += outage.End.Sub(outage.Start)
+			report.Outages = append(report.Outages, *outage)
+			outage = nil
+		}
+	}
+	if outage != nil {
+		outage.End = report.Until
+		outage.Ongoing = true
+		down += outage.End.Sub(outage.Start)
+		report.Outages = append(report.Outages, *outage)
+	}
+	total := report.Until.Sub(report.Since)
+	report.Availability = 100
+	if total > 0 {
+		report.Availability = 100 * (1 - float64(down)/float64(total))
+	}
+	return report, nil
+}
+
+// String returns <report> as lines that can be shown in the shell
+func (report *UptimeReport) String() string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "Peer:\t\t%s\n", report.Peer.Pretty())
+	fmt.Fprintf(&builder, "Period:\t\t%s - %s\n", report.Since.Format(time.RFC3339), report.Until.Format(time.RFC3339))
+	fmt.Fprintf(&builder, "Heartbeats:\t%d (%d failed)\n", report.Checks, report.Failures)
+	fmt.Fprintf(&builder, "Availability:\t%.3f%%\n", report.Availability)
+	fmt.Fprintf(&builder, "Outages:\t%d\n", len(report.Outages))
+	for _, outage := range report.Outages {
+		end := outage.End.Format(time.RFC3339)
+		if outage.Ongoing {
+			end = "now"
+		}
+		fmt.Fprintf(&builder, "  %s - %s (%s)\n", outage.Start.Format(time.RFC3339), end, outage.End.Sub(outage.Start).Truncate(time.Second))
+	}
+	return builder.String()
+}
+
+// History returns the heartbeat history of <node>. It is nil when the
+// history is turned off.
+func (node *PeerNode) History() *HeartbeatHistory {
+	return node.history
+}
+
+// parseUptimeArgs reads the arguments of the <uptime> command: a peer ID or
+// address and an optional <--since> duration, which is 24 hours by default.
+func parseUptimeArgs(args []string) (peer.ID, time.Duration, error) {
+	since := 24 * time.Hour
+	var target string
+	for i := 0; i < len(args); i++ {
+		argument := args[i]
+		var value string
+		switch {
+		case argument == "--since" || argument == "-since":
+			if i+1 == len(args) {
+				return "", 0, fmt.Errorf("%s needs a duration such as 24h", argument)
+			}
+			i++
+			value = args[i]
+		case strings.HasPrefix(argument, "--since="), strings.HasPrefix(argument, "-since="):
+			value = argument[strings.Index(argument, "=")+1:]
+		default:
+			target = argument
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return "", 0, err
+		}
+		since = duration
+	}
+	if target == "" {
+		return "", 0, fmt.Errorf("usage: uptime <peer> [--since 24h]")
+	}
+	peerID, err := parsePeerID(target)
+	return peerID, since, err
+}
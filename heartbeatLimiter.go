@@ -0,0 +1,289 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	net "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	cbor "github.com/multiformats/go-multicodec/cbor"
+)
+
+// idleBucketTimeout is how long the token bucket of a peer that sends
+// nothing is kept before it is dropped
+const idleBucketTimeout = 10 * time.Minute
+
+// violationLogInterval is how often each kind of broken limit is logged at
+// most. A peer that floods us would flood the log otherwise.
+const violationLogInterval = 10 * time.Second
+
+// errHeartbeatTooLarge is returned by reads that go past the maximum
+// heartbeat message size
+var errHeartbeatTooLarge = errors.New("heartbeat message is too large")
+
+// LimitViolation is the kind of limit a heartbeat stream broke
+type LimitViolation string
+
+const (
+	// ViolationMessageSize means the message was larger than
+	// <HeartbeatMaxMessageSize>
+	ViolationMessageSize LimitViolation = "message size"
+	// ViolationRate means the peer sent more heartbeats than its token
+	// bucket allows
+	ViolationRate LimitViolation = "rate"
+	// ViolationStreams means <HeartbeatMaxStreams> heartbeat streams were
+	// open already
+	ViolationStreams LimitViolation = "concurrent streams"
+)
+
+// tokenBucket is the rate limit of one peer. It holds up to <burst> tokens,
+// gets <rate> tokens per second and every heartbeat takes one.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// HeartbeatLimiter is a struct that protects the heartbeat handlers from
+// peers that send too much: it caps the size of a message, the number of
+// heartbeats per peer and second and the number of streams that are served
+// at the same time.
+type HeartbeatLimiter struct {
+	maxMessageSize int64
+	rate           float64
+	burst          float64
+	maxStreams     int
+
+	mutex      sync.Mutex
+	buckets    map[peer.ID]*tokenBucket
+	streams    int
+	violations map[LimitViolation]uint64
+	logged     map[LimitViolation]time.Time
+	unlogged   map[LimitViolation]uint64
+}
+
+// NewHeartbeatLimiter creates a <HeartbeatLimiter> with the limits from
+// <config>. A limit that is 0 or less is turned off.
+func NewHeartbeatLimiter(config *Config) *HeartbeatLimiter {
+	return &HeartbeatLimiter{
+		maxMessageSize: int64(config.HeartbeatMaxMessageSize),
+		rate:           config.HeartbeatRate,
+		burst:          float64(config.HeartbeatBurst),
+		maxStreams:     config.HeartbeatMaxStreams,
+		buckets:        make(map[peer.ID]*tokenBucket),
+		violations:     make(map[LimitViolation]uint64),
+		logged:         make(map[LimitViolation]time.Time),
+		unlogged:       make(map[LimitViolation]uint64),
+	}
+}
+
+// admit decides if a heartbeat stream from <peerID> is served.
+// ----------------------------------------------------------------------------
+// it returns a function that has to be called when the stream is done, and
+// false if the stream broke a limit and has to be reset.
+func (limiter *HeartbeatLimiter) admit(peerID peer.ID) (func(), bool) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	if limiter.maxStreams > 0 && limiter.streams >= limiter.maxStreams {
+		limiter.violateLocked(ViolationStreams, peerID)
+		return nil, false
+	}
+	if limiter.rate > 0 && !limiter.takeLocked(peerID) {
+		limiter.violateLocked(ViolationRate, peerID)
+		return nil, false
+	}
+	limiter.streams++
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			limiter.mutex.Lock()
+			limiter.streams--
+			limiter.mutex.Unlock()
+		})
+	}
+	return release, true
+}
+
+// takeLocked refills the token bucket of <peerID> and takes one token out
+// of it. It returns false if the bucket is empty.
+func (limiter *HeartbeatLimiter) takeLocked(peerID peer.ID) bool {
+	now := time.Now()
+	limiter.pruneLocked(now)
+	bucket, ok := limiter.buckets[peerID]
+	if !ok {
+		bucket = &tokenBucket{tokens: limiter.burst, last: now}
+		limiter.buckets[peerID] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * limiter.rate
+	if bucket.tokens > limiter.burst {
+		bucket.tokens = limiter.burst
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// pruneLocked drops the buckets of peers that were quiet for
+// <idleBucketTimeout>. Those buckets are full again anyway, so nothing is
+// lost.
+func (limiter *HeartbeatLimiter) pruneLocked(now time.Time) {
+	for peerID, bucket := range limiter.buckets {
+		if now.Sub(bucket.last) > idleBucketTimeout {
+			delete(limiter.buckets, peerID)
+		}
+	}
+}
+
+// violation counts and logs a stream of <peerID> that broke <kind>
+func (limiter *HeartbeatLimiter) violation(kind LimitViolation, peerID peer.ID) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.violateLocked(kind, peerID)
+}
+
+// violateLocked is <violation> for callers that hold the mutex already.
+// Every violation is counted, but each kind is logged at most once every
+// <violationLogInterval> together with the number that were not logged.
+func (limiter *HeartbeatLimiter) violateLocked(kind LimitViolation, peerID peer.ID) {
+	limiter.violations[kind]++
+	now := time.Now()
+	if now.Sub(limiter.logged[kind]) < violationLogInterval {
+		limiter.unlogged[kind]++
+		return
+	}
+	fmt.Printf("Heartbeat Limit: %s limit broken by %s (%d so far, %d more since the last message)\n", kind, peerID, limiter.violations[kind], limiter.unlogged[kind])
+	limiter.logged[kind] = now
+	limiter.unlogged[kind] = 0
+}
+
+// Violations returns how often every kind of limit was broken
+func (limiter *HeartbeatLimiter) Violations() map[LimitViolation]uint64 {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	result := make(map[LimitViolation]uint64)
+	for kind, count := range limiter.violations {
+		result[kind] = count
+	}
+	return result
+}
+
+// String returns the limits and the violation counts of <limiter> as lines
+// that can be shown in the shell
+func (limiter *HeartbeatLimiter) String() string {
+	violations := limiter.Violations()
+	result := fmt.Sprintf("Max message size: %d bytes\nRate: %g per second, burst %g\nMax streams: %d\n",
+		limiter.maxMessageSize, limiter.rate, limiter.burst, limiter.maxStreams)
+	var kinds []string
+	for kind := range violations {
+		kinds = append(kinds, string(kind))
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		result += fmt.Sprintf("%s violations: %d\n", kind, violations[LimitViolation(kind)])
+	}
+	return result
+}
+
+// boundedReader is an <io.Reader> that fails with <errHeartbeatTooLarge>
+// once more than a set number of bytes are read from it
+type boundedReader struct {
+	reader    io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+// Read reads from the wrapped reader until the limit is reached
+func (bounded *boundedReader) Read(buffer []byte) (int, error) {
+	if bounded.remaining <= 0 {
+		bounded.exceeded = true
+		return 0, errHeartbeatTooLarge
+	}
+	if int64(len(buffer)) > bounded.remaining {
+		buffer = buffer[:bounded.remaining]
+	}
+	n, err := bounded.reader.Read(buffer)
+	bounded.remaining -= int64(n)
+	return n, err
+}
+
+// boundStream returns a reader of <stream> that stops at the maximum
+// message size of <limiter>. When there is no maximum, <stream> itself is
+// returned.
+func (limiter *HeartbeatLimiter) boundStream(stream net.Stream) (io.Reader, *boundedReader) {
+	if limiter.maxMessageSize <= 0 {
+		return stream, &boundedReader{}
+	}
+	bounded := &boundedReader{reader: stream, remaining: limiter.maxMessageSize}
+	return bounded, bounded
+}
+
+// wrapBoundedDataStream is <WrapDataStream> with a decoder that cannot read
+// more than the maximum message size of <limiter>. <bounded> tells if the
+// limit was hit.
+func (limiter *HeartbeatLimiter) wrapBoundedDataStream(stream net.Stream) (*DataStream, *boundedReader) {
+	reader, bounded := limiter.boundStream(stream)
+	result := WrapDataStream(stream)
+	result.reader = bufio.NewReader(reader)
+	result.decoder = cbor.Multicodec().Decoder(result.reader)
+	return result, bounded
+}
+
+// admitHeartbeat runs the checks every heartbeat handler starts with: the
+// access control list and the rate and stream limits. It also gives the
+// sender <defaultHeartbeatTimeout> to send its message, so slow senders
+// cannot hold on to a stream slot.
+// ----------------------------------------------------------------------------
+// it returns the function that frees the stream slot, or false if
+// <stream> was reset.
+func (node *PeerNode) admitHeartbeat(protocol string, stream net.Stream) (func(), bool) {
+	remote := stream.Conn().RemotePeer()
+	// refuse the stream if the remote peer is not allowed to use
+	// this protocol
+	if !node.streamAllowed(protocol, remote) {
+		stream.Reset()
+		return nil, false
+	}
+	release, ok := node.heartbeatLimiter.admit(remote)
+	if !ok {
+		stream.Reset()
+		return nil, false
+	}
+	stream.SetReadDeadline(time.Now().Add(defaultHeartbeatTimeout))
+	return release, true
+}
+
+// HeartbeatLimiter returns the limits of the heartbeat handlers of <node>
+func (node *PeerNode) HeartbeatLimiter() *HeartbeatLimiter {
+	return node.heartbeatLimiter
+}
@@ -0,0 +1,455 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// recentTransitionsLimit is how many state transitions the monitor keeps
+// for the <watch> view
+const recentTransitionsLimit = 10
+
+// PeerState is the state the heartbeat monitor thinks a peer is in
+type PeerState int
+
+const (
+	// PeerUnknown means the peer was not checked yet
+	PeerUnknown PeerState = iota
+	// PeerUp means the last heartbeat was answered
+	PeerUp
+	// PeerSuspect means the peer missed at least <SuspectAfter> heartbeats
+	PeerSuspect
+	// PeerDown means the peer missed at least <DownAfter> heartbeats
+	PeerDown
+)
+
+// String returns the name of <state> as it is shown in the shell
+func (state PeerState) String() string {
+	switch state {
+	case PeerUp:
+		return "up"
+	case PeerSuspect:
+		return "suspect"
+	case PeerDown:
+		return "down"
+	default:
+		return "unknown"
+	}
+}
+
+// PeerStatus is a struct that holds what the monitor knows about a peer.
+// <Failures> is the number of heartbeats in a row that were not answered.
+// <Authenticated> is true when the last answer was signed by the peer.
+// <Successes> is the number of heartbeats in a row that were answered,
+// <Interval> is the current time between two heartbeats and <NextCheck> is
+// when the next one is sent.
+type PeerStatus struct {
+	Peer          peer.ID
+	Address       string
+	State         PeerState
+	LastSeen      time.Time
+	LastChecked   time.Time
+	Failures      int
+	Successes     int
+	LastError     string
+	Authenticated bool
+	Interval      time.Duration
+	NextCheck     time.Time
+
+	// checking is true while a heartbeat to the peer is on its way
+	checking bool
+}
+
+// StateTransition is an event that is sent every time a peer changes state.
+// <Error> is the reason of the last failed heartbeat, if there is one.
+type StateTransition struct {
+	Peer  peer.ID
+	From  PeerState
+	To    PeerState
+	Time  time.Time
+	Error string
+}
+
+// String returns <transition> as a line that can be shown in the shell
+func (transition StateTransition) String() string {
+	line := fmt.Sprintf("%s %s: %s -> %s", transition.Time.Format("15:04:05"), transition.Peer, transition.From, transition.To)
+	if transition.Error != "" {
+		line += " (" + transition.Error + ")"
+	}
+	return line
+}
+
+// HeartbeatMonitor is a struct that sends heartbeats to a set of peers and
+// keeps track of which of them are up, suspected or down.
+// Unless the adaptive interval is turned off, every peer is checked at its
+// own pace: faster after a missed heartbeat, slower when it has been stable
+// for a while and with an exponential backoff while it is down.
+type HeartbeatMonitor struct {
+	node         *PeerNode
+	interval     time.Duration
+	timeout      time.Duration
+	suspectAfter int
+	downAfter    int
+	adaptive     bool
+	minInterval  time.Duration
+	maxInterval  time.Duration
+	maxBackoff   time.Duration
+	stableAfter  int
+
+	mutex       sync.RWMutex
+	peers       map[peer.ID]*PeerStatus
+	subscribers []chan StateTransition
+	recent      []StateTransition
+	stop        chan struct{}
+	wake        chan struct{}
+}
+
+// NewHeartbeatMonitor creates a heartbeat monitor for <node>. The monitor
+// does not send anything until <Start> is called.
+// ----------------------------------------------------------------------------
+// <node> is a parameter of pointer type to <PeerNode> that sends the
+// heartbeats.
+// <config> is a parameter of pointer type to <Config> that holds the
+// interval, timeout and thresholds of the monitor.
+// ----------------------------------------------------------------------------
+// it returns a pointer to <HeartbeatMonitor> struct
+func NewHeartbeatMonitor(node *PeerNode, config *Config) *HeartbeatMonitor {
+	monitor := &HeartbeatMonitor{
+		node:         node,
+		interval:     config.HeartbeatInterval.Duration,
+		timeout:      config.HeartbeatTimeout.Duration,
+		suspectAfter: config.SuspectAfter,
+		downAfter:    config.DownAfter,
+		adaptive:     !config.DisableAdaptiveHeartbeat,
+		minInterval:  config.HeartbeatMinInterval.Duration,
+		maxInterval:  config.HeartbeatMaxInterval.Duration,
+		maxBackoff:   config.HeartbeatMaxBackoff.Duration,
+		stableAfter:  config.HeartbeatStableAfter,
+		peers:        make(map[peer.ID]*PeerStatus),
+		wake:         make(chan struct{}, 1),
+	}
+	// limits that are not set, or set the wrong way around, fall back to
+	// the fixed interval
+	if monitor.minInterval <= 0 || monitor.minInterval > monitor.interval {
+		monitor.minInterval = monitor.interval
+	}
+	if monitor.maxInterval < monitor.interval {
+		monitor.maxInterval = monitor.interval
+	}
+	if monitor.maxBackoff < monitor.interval {
+		monitor.maxBackoff = monitor.interval
+	}
+	return monitor
+}
+
+// Add adds the peer that <address> points to to the monitored peers.
+// ----------------------------------------------------------------------------
+// <address> is a parameter of string type that is the IPFS address of the
+// peer.
+// ----------------------------------------------------------------------------
+// it returns the peer ID of the added peer or an error if <address> is not
+// valid
+func (monitor *HeartbeatMonitor) Add(address string) (peer.ID, error) {
+	peerID, err := addAddressToPeerstore(monitor.node, address)
+	if err != nil {
+		return peerID, err
+	}
+	monitor.mutex.Lock()
+	if _, ok := monitor.peers[peerID]; !ok {
+		monitor.peers[peerID] = &PeerStatus{Peer: peerID, Address: address, Interval: monitor.interval}
+	}
+	monitor.mutex.Unlock()
+	// a new peer is due right away
+	monitor.poke()
+	return peerID, nil
+}
+
+// Remove stops monitoring <peerID>. The failure detector forgets it too,
+// since no more heartbeats of it will arrive.
+func (monitor *HeartbeatMonitor) Remove(peerID peer.ID) {
+	monitor.mutex.Lock()
+	delete(monitor.peers, peerID)
+	monitor.mutex.Unlock()
+	monitor.node.detector.Forget(peerID)
+}
+
+// Start starts sending heartbeats in the background. Calling it on a
+// monitor that runs already does nothing.
+func (monitor *HeartbeatMonitor) Start() {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	if monitor.stop != nil {
+		return
+	}
+	monitor.stop = make(chan struct{})
+	go monitor.run(monitor.stop)
+}
+
+// Stop stops sending heartbeats. The state of every peer is kept.
+func (monitor *HeartbeatMonitor) Stop() {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	if monitor.stop == nil {
+		return
+	}
+	close(monitor.stop)
+	monitor.stop = nil
+}
+
+// Subscribe returns a channel that receives every state transition from now
+// on. Slow readers miss transitions instead of blocking the monitor.
+func (monitor *HeartbeatMonitor) Subscribe() <-chan StateTransition {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	subscriber := make(chan StateTransition, 64)
+	monitor.subscribers = append(monitor.subscribers, subscriber)
+	return subscriber
+}
+
+// run checks every peer when it is due until <stop> is closed. Every peer
+// has its own interval, so the loop sleeps until the next peer is due or a
+// peer is added.
+func (monitor *HeartbeatMonitor) run(stop chan struct{}) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-monitor.wake:
+		case <-timer.C:
+		}
+		next := monitor.checkDue(time.Now())
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Until(next))
+	}
+}
+
+// checkDue sends a heartbeat to every peer that is due and not checked
+// already, each in its own goroutine.
+// ----------------------------------------------------------------------------
+// it returns the time the next peer is due
+func (monitor *HeartbeatMonitor) checkDue(now time.Time) time.Time {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	next := now.Add(monitor.interval)
+	for peerID, status := range monitor.peers {
+		if status.checking {
+			continue
+		}
+		if !status.NextCheck.After(now) {
+			status.checking = true
+			go monitor.check(peerID)
+			continue
+		}
+		if status.NextCheck.Before(next) {
+			next = status.NextCheck
+		}
+	}
+	return next
+}
+
+// check sends one heartbeat to <peerID> and records the result
+func (monitor *HeartbeatMonitor) check(peerID peer.ID) {
+	ctx, cancel := context.WithTimeout(context.Background(), monitor.timeout)
+	defer cancel()
+	// a node that only speaks <"/heartbeat/1.0.0"> answers without a
+	// signature. It is still up, <Authenticated> shows that it did not sign.
+	result, err := monitor.node.sendHeartbeat(ctx, peerID)
+	interval, ok := monitor.record(peerID, result, err)
+	// only the heartbeats of the monitor are arrivals for the failure
+	// detector. They come at a steady pace, a manual heartbeat or a probe
+	// would make the detector expect the next one far too early. The
+	// detector is told the interval of the next heartbeat, which changes
+	// with the adaptive heartbeat.
+	if err == nil && ok {
+		monitor.node.detector.Heartbeat(peerID, time.Now(), interval)
+	}
+	// the run loop has to plan the next heartbeat of this peer
+	monitor.poke()
+}
+
+// poke wakes up the run loop. It never blocks, one pending wake up is
+// enough.
+func (monitor *HeartbeatMonitor) poke() {
+	select {
+	case monitor.wake <- struct{}{}:
+	default:
+	}
+}
+
+// nextInterval picks how long to wait before the next heartbeat to a peer
+// in <status>, which already holds the result of the last heartbeat.
+// ----------------------------------------------------------------------------
+// - a peer that just missed a heartbeat but is not down is checked at the
+// minimum interval, so a failure is confirmed quickly;
+// - a down peer is checked less and less often, the interval doubles with
+// every miss up to the maximum backoff;
+// - a peer that answered <stableAfter> heartbeats in a row gets a 50%
+// longer interval with every answer, up to the maximum interval;
+// - every other peer is checked at the configured interval.
+func (monitor *HeartbeatMonitor) nextInterval(status *PeerStatus) time.Duration {
+	if !monitor.adaptive {
+		return monitor.interval
+	}
+	switch {
+	case status.State == PeerDown:
+		interval := status.Interval * 2
+		if interval < monitor.interval {
+			interval = monitor.interval
+		}
+		if interval > monitor.maxBackoff {
+			interval = monitor.maxBackoff
+		}
+		return interval
+	case status.Failures > 0:
+		return monitor.minInterval
+	case status.Successes >= monitor.stableAfter:
+		interval := status.Interval + status.Interval/2
+		if interval > monitor.maxInterval {
+			interval = monitor.maxInterval
+		}
+		return interval
+	default:
+		return monitor.interval
+	}
+}
+
+// record updates the state of <peerID> with the result of a heartbeat and
+// sends a transition event if the state changed.
+// ----------------------------------------------------------------------------
+// it returns the interval until the next heartbeat to <peerID>, and false
+// if <peerID> is not monitored anymore.
+func (monitor *HeartbeatMonitor) record(peerID peer.ID, result *HeartbeatResult, err error) (time.Duration, bool) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	status, ok := monitor.peers[peerID]
+	if !ok {
+		// the peer was removed while the heartbeat was on its way
+		return 0, false
+	}
+	now := time.Now()
+	previous := status.State
+	status.LastChecked = now
+	if err == nil {
+		status.State = PeerUp
+		status.LastSeen = now
+		status.Failures = 0
+		status.Successes++
+		status.LastError = ""
+		status.Authenticated = result.Authenticated
+	} else {
+		status.Failures++
+		status.Successes = 0
+		status.LastError = err.Error()
+		switch {
+		case status.Failures >= monitor.downAfter:
+			status.State = PeerDown
+		case status.Failures >= monitor.suspectAfter:
+			status.State = PeerSuspect
+		}
+	}
+	status.checking = false
+	status.Interval = monitor.nextInterval(status)
+	status.NextCheck = now.Add(status.Interval)
+	if status.State == previous {
+		return status.Interval, true
+	}
+	transition := StateTransition{
+		Peer:  peerID,
+		From:  previous,
+		To:    status.State,
+		Time:  now,
+		Error: status.LastError,
+	}
+	monitor.recent = append(monitor.recent, transition)
+	if len(monitor.recent) > recentTransitionsLimit {
+		monitor.recent = monitor.recent[len(monitor.recent)-recentTransitionsLimit:]
+	}
+	for _, subscriber := range monitor.subscribers {
+		select {
+		case subscriber <- transition:
+		default:
+		}
+	}
+	return status.Interval, true
+}
+
+// Snapshot returns a copy of the status of every monitored peer, sorted by
+// peer ID.
+func (monitor *HeartbeatMonitor) Snapshot() []PeerStatus {
+	monitor.mutex.RLock()
+	defer monitor.mutex.RUnlock()
+	var result []PeerStatus
+	for _, status := range monitor.peers {
+		result = append(result, *status)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Peer < result[j].Peer
+	})
+	return result
+}
+
+// RecentTransitions returns the last state transitions, oldest first
+func (monitor *HeartbeatMonitor) RecentTransitions() []StateTransition {
+	monitor.mutex.RLock()
+	defer monitor.mutex.RUnlock()
+	return append([]StateTransition(nil), monitor.recent...)
+}
+
+// FormatPeerStatusTable turns a list of <PeerStatus> into a table that can
+// be shown in the shell.
+func FormatPeerStatusTable(statuses []PeerStatus) string {
+	var buffer bytes.Buffer
+	writer := tabwriter.NewWriter(&buffer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "PEER\tSTATE\tAUTH\tLAST SEEN\tINTERVAL\tFAILURES\tLAST ERROR")
+	for _, status := range statuses {
+		lastSeen := "never"
+		if !status.LastSeen.IsZero() {
+			lastSeen = time.Since(status.LastSeen).Truncate(time.Second).String() + " ago"
+		}
+		auth := "no"
+		if status.Authenticated {
+			auth = "yes"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", status.Peer.Pretty(), status.State, auth, lastSeen, status.Interval, status.Failures, status.LastError)
+	}
+	writer.Flush()
+	return buffer.String()
+}
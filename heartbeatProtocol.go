@@ -30,8 +30,12 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"time"
 
+	network "github.com/libp2p/go-libp2p-core/network"
 	net "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	protocol "github.com/libp2p/go-libp2p-protocol"
 )
 
 // Heartbeat protocol is used to see if a node is still online.
@@ -39,6 +43,28 @@ import (
 // the other node would reply back with a message
 const heartbeatprotocol = "/heartbeat/1.0.0"
 
+// defaultHeartbeatTimeout is how long a single heartbeat can take before
+// the receiver node is considered unreachable
+const defaultHeartbeatTimeout = 10 * time.Second
+
+// HeartbeatResult is a struct that holds the outcome of one heartbeat:
+// the <Reply> of the receiver node and the round trip time <RTT> between
+// writing the message and reading the whole reply.
+// <Protocol> is the heartbeat version the receiver node answered with.
+// <Reply> is only set by <"/heartbeat/1.0.0"> and <Response> only by
+// <"/heartbeat/2.0.0">.
+// <Authenticated> is true when the receiver node signed our challenge with
+// the key of <Peer>, so the reply could not come from anyone else.
+type HeartbeatResult struct {
+	Peer          peer.ID
+	Protocol      string
+	Time          time.Time
+	RTT           time.Duration
+	Reply         string
+	Response      *HeartbeatResponse
+	Authenticated bool
+}
+
 // Heartbeat is the main function that is called for
 // heartbeat protocol
 // ----------------------------------------------------------
@@ -50,19 +76,136 @@ const heartbeatprotocol = "/heartbeat/1.0.0"
 // IPFS address of the node that is getting checked to see
 // if it can receive messages or not.
 func (node *PeerNode) Heartbeat(destination string) {
+	result, err := node.checkHeartbeat(destination)
+	if err != nil {
+		panic(err)
+	}
+	peerID := result.Peer
+	// It shows the value of the stream after it was modified
+	// on the receiver node and how long the round trip took.
+	if result.Response != nil {
+		fmt.Printf("%s Reply:\n%s", peerID, result.Response)
+	} else {
+		fmt.Printf("%s Reply: %s\n", peerID, result.Reply)
+	}
+	fmt.Printf("Round Trip Time: %s\n", result.RTT)
+	if result.Authenticated {
+		fmt.Printf("Authenticated: the reply is signed by %s\n", peerID)
+	} else {
+		fmt.Printf("Not Authenticated: %s did not sign the reply\n", peerID)
+	}
+
+}
+
+// checkHeartbeat adds <destination> to the address book of <node> and sends
+// one heartbeat to it, like <Heartbeat> without printing the reply.
+// ----------------------------------------------------------------------------
+// it returns a pointer to <HeartbeatResult> with the reply of the receiver
+// node.
+// It returns an error in case <destination> is not a valid address or the
+// receiver node could not be reached.
+func (node *PeerNode) checkHeartbeat(destination string) (*HeartbeatResult, error) {
 	// First, we add the peer node <destination> string points to
 	// <node> local address book
 	peerID, err := addAddressToPeerstore(node, destination)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	// <sendHeartbeat> does the actual exchange with the receiver node
+	ctx, cancel := context.WithTimeout(context.Background(), defaultHeartbeatTimeout)
+	defer cancel()
+	return node.sendHeartbeat(ctx, peerID)
+}
+
+// sendHeartbeat sends one heartbeat message to <peerID> and waits for
+// the reply. It is used by <Heartbeat> and by the heartbeat monitor.
+// ----------------------------------------------------------------------------
+// <node> is a receiver of pointer type to <PeerNode>.
+// <ctx> is a parameter of <context.Context> type. When it has a deadline,
+// the whole exchange has to finish before it.
+// <peerID> is the peer that is checked. Its address has to be in the
+// address book of <node> already.
+// ----------------------------------------------------------------------------
+// it returns a pointer to <HeartbeatResult> with the reply of the receiver
+// node and the round trip time, which is also added to the latency
+// statistics of <peerID>.
+// It returns an error in case the receiver node could not be reached.
+// Every result, answered or not, is added to the heartbeat history. The
+// text reply of a node that only speaks <"/heartbeat/1.0.0"> counts as an
+// answer, <result.Authenticated> tells whether it was signed.
+func (node *PeerNode) sendHeartbeat(ctx context.Context, peerID peer.ID) (*HeartbeatResult, error) {
+	result, err := node.sendHeartbeatWith(ctx, peerID, nil)
+	node.history.record(peerID, result, err)
+	return result, err
+}
+
+// sendHeartbeatWith opens a heartbeat stream to <peerID> and runs one
+// exchange on it. <prepare> is a function that can change the
+// <"/heartbeat/2.0.0"> request before it is sent. It is used by the cluster
+// membership to send join requests and probes. When <prepare> is not nil,
+// receiver nodes that only speak <"/heartbeat/1.0.0"> are not accepted,
+// since they would not understand the request.
+// Unlike <sendHeartbeat>, the result is not added to the heartbeat history:
+// a cluster probes a member every <ProbeInterval> and would fill the
+// history with records nobody asked for.
+func (node *PeerNode) sendHeartbeatWith(ctx context.Context, peerID peer.ID, prepare func(*HeartbeatRequest)) (*HeartbeatResult, error) {
 	// <node> creates a new stream by calling  <NewStream>
-	// function and passing background context, receiver's
-	// <peerID> and <heartbeatprotocol> (<"/heartbeat/1.0.0">)
-	stream, err := node.NewStream(context.Background(), peerID, heartbeatprotocol)
+	// function and passing a relay friendly context, receiver's
+	// <peerID> and the heartbeat protocols. <"/heartbeat/2.0.0"> comes
+	// first so that it is used whenever the receiver node supports it, and
+	// older nodes still answer <"/heartbeat/1.0.0">.
+	protocols := []protocol.ID{heartbeatProtocolV2, heartbeatprotocol}
+	if prepare != nil {
+		protocols = protocols[:1]
+	}
+	stream, err := node.NewStream(network.WithUseTransient(ctx, heartbeatprotocol), peerID, protocols...)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	// a stream that does not answer in time is reset, so the deadline of
+	// <ctx> is also set on the stream.
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+	result := &HeartbeatResult{
+		Peer:     peerID,
+		Protocol: string(stream.Protocol()),
+	}
+	// the round trip time is measured from the moment the message is
+	// written until the whole reply is read, so opening the stream is
+	// not part of it.
+	result.Time = time.Now()
+	if stream.Protocol() == heartbeatProtocolV2 {
+		err = node.exchangeHeartbeatV2(stream, result, prepare)
+	} else if node.speaksHeartbeatV2(peerID) {
+		// a node that answered <"/heartbeat/2.0.0"> before does not go
+		// back to the unsigned version, someone in between is hiding it
+		err = fmt.Errorf("%s speaks %s but answered %s", peerID, heartbeatProtocolV2, heartbeatprotocol)
+	} else {
+		err = node.exchangeHeartbeatV1(stream, result)
+	}
+	if err != nil {
+		stream.Reset()
+		return nil, err
 	}
+	result.RTT = time.Since(result.Time)
+	stream.Close()
+	node.recordLatency(peerID, result.RTT)
+	return result, nil
+}
+
+// speaksHeartbeatV2 tells if <peerID> is known to serve
+// <"/heartbeat/2.0.0">, either from an earlier signed heartbeat or from the
+// protocols it announced when it connected.
+func (node *PeerNode) speaksHeartbeatV2(peerID peer.ID) bool {
+	protocols, err := node.Peerstore().SupportsProtocols(peerID, heartbeatProtocolV2)
+	return err == nil && len(protocols) > 0
+}
+
+// exchangeHeartbeatV1 writes a <"/heartbeat/1.0.0"> message to <stream> and
+// stores the text reply in <result>. A reply longer than
+// <HeartbeatMaxMessageSize> fails the heartbeat.
+func (node *PeerNode) exchangeHeartbeatV1(stream net.Stream, result *HeartbeatResult) error {
 	// it would use <stream.Conn().LocalPeer()> to find the
 	// peer id of the current node that is sending the message
 	sender := stream.Conn().LocalPeer()
@@ -71,22 +214,22 @@ func (node *PeerNode) Heartbeat(destination string) {
 	message := fmt.Sprintf(" %s is checking availablity\n", sender)
 	// it writes the <message> to stream in byte array format
 	// so that the byte array is sent to the receiver node
-	_, err = stream.Write([]byte(message))
+	_, err := stream.Write([]byte(message))
 	if err != nil {
-		panic(err)
+		return err
 	}
 	// it reads back the stream. If the stream is sent
 	// successfully,the stream is modified on the receiver node
 	// so <ioutil.ReadAll()> is used to read back the
-	// stream's content again.
-	requestReceiver, err := ioutil.ReadAll(stream)
+	// stream's content again, through a bounded reader so the
+	// receiver cannot make us read an endless reply.
+	reader, _ := node.heartbeatLimiter.boundStream(stream)
+	requestReceiver, err := ioutil.ReadAll(reader)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	// It shows the value of the stream after it was modified
-	// on the receiver node.
-	fmt.Printf("%s Reply: %s\n", peerID, requestReceiver)
-
+	result.Reply = string(requestReceiver)
+	return nil
 }
 
 // HeartbeatProtocolMultiplexer Multiplexes "/heartbeat/1.0.0"
@@ -104,16 +247,29 @@ func (node *PeerNode) HeartbeatProtocolMultiplexer() {
 	// with the same string attached is received by a node,that code
 	// inside anonymous function is executed on the receiver node
 	node.SetStreamHandler(heartbeatprotocol, func(stream net.Stream) {
+		// refuse the stream if the remote peer is not allowed to use
+		// this protocol or sends too many heartbeats
+		release, ok := node.admitHeartbeat(heartbeatprotocol, stream)
+		if !ok {
+			return
+		}
+		defer release()
 		fmt.Println("Request Receiver : New connection intiated")
 		// <bufio.NewReader(stream net.Stream)> is used to read
-		// the data passed in the stream as buffer
-		buf := bufio.NewReader(stream)
+		// the data passed in the stream as buffer. The stream is
+		// bounded so a peer cannot send us an endless line.
+		reader, bounded := node.heartbeatLimiter.boundStream(stream)
+		buf := bufio.NewReader(reader)
 		// <ReadString()> is used t read the received string from
 		// buffer <buf>
 		str, err := buf.ReadString('\n')
 		// check to make sure the stream doesn't have any issues.
 		if err != nil {
-			fmt.Println(err)
+			if bounded.exceeded {
+				node.heartbeatLimiter.violation(ViolationMessageSize, stream.Conn().RemotePeer())
+			} else {
+				fmt.Println(err)
+			}
 			stream.Reset()
 		} else {
 			// It shows the message it received.
@@ -137,5 +293,13 @@ func (node *PeerNode) HeartbeatProtocolMultiplexer() {
 
 	})
 	fmt.Printf("Heartbeat Protocol 1.0.0 Multiplexd!\n")
+	// <"/heartbeat/2.0.0"> runs next to <"/heartbeat/1.0.0"> so that
+	// nodes of both versions can check each other.
+	node.SetStreamHandler(heartbeatProtocolV2, node.handleHeartbeatV2)
+	fmt.Printf("Heartbeat Protocol 2.0.0 Multiplexd!\n")
+	// the topology protocol shares what the heartbeats found out, so it is
+	// served by every node that runs the heartbeat protocol
+	node.SetStreamHandler(topologyProtocol, node.handleTopology)
+	fmt.Printf("Topology Protocol 1.0.0 Multiplexd!\n")
 
 }
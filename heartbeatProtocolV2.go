@@ -0,0 +1,270 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	net "github.com/libp2p/go-libp2p-net"
+)
+
+// Heartbeat protocol 2.0.0 does the same job as heartbeat protocol 1.0.0,
+// but instead of free-form text both sides send a <cbor> encoded message
+// that describes the node.
+const heartbeatProtocolV2 = "/heartbeat/2.0.0"
+
+// agentVersion is the name and version this node reports to other nodes
+const agentVersion = "libp2p-examples/2.0.0"
+
+// LoadFigures is a struct that holds numbers that show how busy a node is.
+// <LoadAverage> is the one minute load average of the machine, it is 0 on
+// systems that do not have </proc/loadavg>.
+type LoadFigures struct {
+	Goroutines  int
+	Peers       int
+	Connections int
+	Streams     int
+	LoadAverage float64
+}
+
+// NodeInfo is a struct that holds the metadata a node sends in every
+// <"/heartbeat/2.0.0"> message. <Uptime> is in seconds.
+type NodeInfo struct {
+	AgentVersion string
+	Uptime       int64
+	Protocols    []string
+	Load         LoadFigures
+}
+
+// HeartbeatRequest is the message the checking node sends.
+// <Seq> grows by one with every heartbeat the node sends and <Timestamp> is
+// the time it was sent in Unix nanoseconds. <Nonce> is a random challenge
+// the receiver has to sign.
+// The other fields are used by the cluster membership: <Gossip> holds the
+// piggybacked membership updates, <Join> asks for every known member and
+// <ProbeTarget> asks the receiver to probe another member on behalf of the
+// sender. <ProbeAddrs> holds the sender's addresses for the target; the
+// receiver only uses the addresses it learned itself.
+type HeartbeatRequest struct {
+	Seq         uint64
+	Timestamp   int64
+	Nonce       []byte
+	Info        NodeInfo
+	Gossip      []MemberUpdate
+	Join        bool
+	ProbeTarget string
+	ProbeAddrs  []string
+}
+
+// HeartbeatResponse is the message the checked node sends back. <Seq> is
+// the sequence number of the request it answers.
+// <ProbeAck> is true when the request had a <ProbeTarget> and the target
+// answered the probe of the receiver.
+// <Signature> is the signature of the nonce of the request and <Timestamp>
+// made with the private key of the receiver, and <PublicKey> is the key to
+// check it with.
+type HeartbeatResponse struct {
+	Seq       uint64
+	Timestamp int64
+	Info      NodeInfo
+	Gossip    []MemberUpdate
+	ProbeAck  bool
+	Signature []byte
+	PublicKey []byte
+}
+
+// String returns <response> as lines that can be shown in the shell
+func (response *HeartbeatResponse) String() string {
+	return fmt.Sprintf("  Seq:\t\t%d\n  Time:\t\t%s\n  Agent:\t%s\n  Uptime:\t%s\n  Protocols:\t%s\n  Load:\t\t%+v\n",
+		response.Seq,
+		time.Unix(0, response.Timestamp).Format(time.RFC3339),
+		response.Info.AgentVersion,
+		time.Duration(response.Info.Uptime)*time.Second,
+		strings.Join(response.Info.Protocols, ", "),
+		response.Info.Load)
+}
+
+// nodeInfo collects the metadata of <node> that goes into every
+// <"/heartbeat/2.0.0"> message.
+func (node *PeerNode) nodeInfo() NodeInfo {
+	var info NodeInfo
+	info.AgentVersion = agentVersion
+	info.Uptime = int64(time.Since(node.started) / time.Second)
+	info.Protocols = node.Mux().Protocols()
+	sort.Strings(info.Protocols)
+	info.Load.Goroutines = runtime.NumGoroutine()
+	info.Load.Peers = len(node.Network().Peers())
+	conns := node.Network().Conns()
+	info.Load.Connections = len(conns)
+	for _, conn := range conns {
+		info.Load.Streams += len(conn.GetStreams())
+	}
+	info.Load.LoadAverage = loadAverage()
+	return info
+}
+
+// loadAverage reads the one minute load average from </proc/loadavg>
+func loadAverage() float64 {
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0
+	}
+	return value
+}
+
+// exchangeHeartbeatV2 writes a <HeartbeatRequest> to <stream>, reads the
+// <HeartbeatResponse> and stores it in <result>.
+// ----------------------------------------------------------------------------
+// <prepare> is called on the request before it is sent, if it is not nil.
+// ----------------------------------------------------------------------------
+// It returns an error in case the response cannot be decoded or answers
+// another request.
+func (node *PeerNode) exchangeHeartbeatV2(stream net.Stream, result *HeartbeatResult, prepare func(*HeartbeatRequest)) error {
+	// we reuse <DataStream> from sync protocol since it already wraps a
+	// stream with a <cbor> encoder and decoder. The reply is read through
+	// a bounded reader like the requests of <handleHeartbeatV2>.
+	wrappedStream, _ := node.heartbeatLimiter.wrapBoundedDataStream(stream)
+	nonce, err := newHeartbeatNonce()
+	if err != nil {
+		return err
+	}
+	request := HeartbeatRequest{
+		Seq:       atomic.AddUint64(&node.heartbeatSequence, 1),
+		Timestamp: time.Now().UnixNano(),
+		Nonce:     nonce,
+		Info:      node.nodeInfo(),
+		Gossip:    node.membership.gossip(false),
+	}
+	if prepare != nil {
+		prepare(&request)
+	}
+	err = wrappedStream.encoder.Encode(&request)
+	if err != nil {
+		return err
+	}
+	// output is buffered with <bufio> so <Flush> has to get called
+	err = wrappedStream.writer.Flush()
+	if err != nil {
+		return err
+	}
+	var response HeartbeatResponse
+	err = wrappedStream.decoder.Decode(&response)
+	if err != nil {
+		return err
+	}
+	if response.Seq != request.Seq {
+		return fmt.Errorf("heartbeat reply has sequence number %d instead of %d", response.Seq, request.Seq)
+	}
+	// a relay in the path could answer for the receiver, so the reply only
+	// counts as proof of life when the receiver signed our challenge. A bad
+	// or missing signature fails the heartbeat.
+	err = verifyHeartbeat(result.Peer, &request, &response)
+	if err != nil {
+		return err
+	}
+	result.Authenticated = true
+	// the receiver is remembered as a <"/heartbeat/2.0.0"> node, so a
+	// later answer with <"/heartbeat/1.0.0"> is not accepted from it
+	node.Peerstore().AddProtocols(result.Peer, heartbeatProtocolV2)
+	// what the receiver knows about the cluster comes back with the reply
+	node.membership.apply(result.Peer, response.Gossip, request.Join)
+	result.Response = &response
+	return nil
+}
+
+// handleHeartbeatV2 is the stream handler of <"/heartbeat/2.0.0">. It reads
+// one <HeartbeatRequest> and answers it with a <HeartbeatResponse> that
+// holds the metadata of <node>.
+func (node *PeerNode) handleHeartbeatV2(stream net.Stream) {
+	// refuse the stream if the remote peer is not allowed to use
+	// this protocol or sends too many heartbeats
+	release, ok := node.admitHeartbeat(heartbeatProtocolV2, stream)
+	if !ok {
+		return
+	}
+	defer release()
+	// the request is read through a bounded reader, so a peer cannot make
+	// us decode an endless message
+	wrappedStream, bounded := node.heartbeatLimiter.wrapBoundedDataStream(stream)
+	var request HeartbeatRequest
+	err := wrappedStream.decoder.Decode(&request)
+	if err != nil {
+		if bounded.exceeded {
+			node.heartbeatLimiter.violation(ViolationMessageSize, stream.Conn().RemotePeer())
+		} else {
+			fmt.Println(err)
+		}
+		stream.Reset()
+		return
+	}
+	// a joining node gets every member we know, if <node> is part of a
+	// cluster. A join request does not make <node> part of one.
+	node.membership.apply(stream.Conn().RemotePeer(), request.Gossip, request.Join)
+	response := HeartbeatResponse{
+		Seq:       request.Seq,
+		Timestamp: time.Now().UnixNano(),
+		Info:      node.nodeInfo(),
+		Gossip:    node.membership.gossip(request.Join),
+	}
+	// an indirect probe: the sender could not reach <ProbeTarget> and asks
+	// us to try. Only members can ask, and only about members.
+	if request.ProbeTarget != "" {
+		response.ProbeAck = node.membership.probeFor(stream.Conn().RemotePeer(), request.ProbeTarget)
+	}
+	// the timestamp is set again right before signing, so it says when the
+	// challenge was answered
+	response.Timestamp = time.Now().UnixNano()
+	err = node.signHeartbeat(&request, &response)
+	if err != nil {
+		fmt.Println(err)
+		stream.Reset()
+		return
+	}
+	err = wrappedStream.encoder.Encode(&response)
+	if err == nil {
+		err = wrappedStream.writer.Flush()
+	}
+	if err != nil {
+		fmt.Println(err)
+		stream.Reset()
+		return
+	}
+	stream.Close()
+}
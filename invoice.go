@@ -0,0 +1,308 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	bolt "go.etcd.io/bbolt"
+)
+
+// invoicePrefix starts the text form of every invoice, so that an invoice
+// can be told apart from a file name or an address
+const invoicePrefix = "invoice1:"
+
+// The payee keeps every invoice it created in this bucket of the ledger
+// database, keyed by the ID of the invoice
+var invoicesBucket = []byte("invoices")
+
+// Invoice is a request for a payment that the payee creates and hands to
+// the payer, as text or as a file.
+// <Payee> is the address the payment has to be sent to, <ID> is what the
+// payer puts in the <Invoice> field of its transaction and the invoice
+// cannot be paid after <Expires>. The invoice is signed by the payee, so
+// the payer knows it was not changed on the way.
+type Invoice struct {
+	ID        string
+	Payee     string
+	Amount    Money
+	Memo      string `json:",omitempty"`
+	Created   time.Time
+	Expires   time.Time
+	Signature []byte
+	PublicKey []byte
+}
+
+// InvoiceRecord is an invoice as the payee keeps it, with who paid it and
+// with which transaction once it is paid
+type InvoiceRecord struct {
+	Invoice     Invoice
+	Paid        bool
+	PaidBy      string    `json:",omitempty"`
+	Transaction string    `json:",omitempty"`
+	PaidAt      time.Time `json:",omitempty"`
+}
+
+// ErrInvoice is returned when a transaction does not settle the invoice it
+// names
+type ErrInvoice struct {
+	ID     string
+	Reason string
+}
+
+// Error returns the reason of <err> as text
+func (err *ErrInvoice) Error() string {
+	return fmt.Sprintf("invoice %s: %s", err.ID, err.Reason)
+}
+
+// signingBytes returns the canonical encoding of <invoice> that the payee
+// signs. It covers every field but the signature itself.
+func (invoice *Invoice) signingBytes() []byte {
+	return newCanonicalEncoder("libp2p-examples invoice").
+		String(invoice.ID).
+		String(invoice.Payee).
+		Int(invoice.Amount.Units).
+		String(invoice.Amount.Asset).
+		String(invoice.Memo).
+		Int(invoice.Created.UnixNano()).
+		Int(invoice.Expires.UnixNano()).
+		Encoded()
+}
+
+// Encode returns the text form of <invoice>, which can be pasted into the
+// shell of the payer
+func (invoice *Invoice) Encode() string {
+	data, err := json.Marshal(invoice)
+	if err != nil {
+		panic(err)
+	}
+	return invoicePrefix + base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeInvoice reads an invoice from its text form, or from a file that
+// holds the text form
+// ----------------------------------------------------------------------------
+// It returns an error in case <input> is neither.
+func DecodeInvoice(input string) (*Invoice, error) {
+	input = strings.TrimSpace(input)
+	if !strings.HasPrefix(input, invoicePrefix) {
+		data, err := ioutil.ReadFile(input)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither an invoice nor a file with one: %s", input, err)
+		}
+		input = strings.TrimSpace(string(data))
+		if !strings.HasPrefix(input, invoicePrefix) {
+			return nil, fmt.Errorf("the file does not hold an invoice")
+		}
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(input, invoicePrefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid invoice: %s", err)
+	}
+	invoice := &Invoice{}
+	err = json.Unmarshal(data, invoice)
+	if err != nil {
+		return nil, fmt.Errorf("invalid invoice: %s", err)
+	}
+	return invoice, nil
+}
+
+// Verify checks that <invoice> is signed by the node of its <Payee> address
+// and can still be paid.
+// ----------------------------------------------------------------------------
+// It returns an error in case the signature is not valid or the invoice
+// has expired.
+func (invoice *Invoice) Verify() error {
+	payee, err := IpfsAddressToPeerID(invoice.Payee)
+	if err != nil {
+		return fmt.Errorf("invalid payee %q: %s", invoice.Payee, err)
+	}
+	err = verifySignature(payee, invoice.signingBytes(), invoice.Signature, invoice.PublicKey)
+	if err != nil {
+		return fmt.Errorf("invoice: %s", err)
+	}
+	if time.Now().After(invoice.Expires) {
+		return &ErrInvoice{ID: invoice.ID, Reason: "expired at " + invoice.Expires.Format(time.RFC3339)}
+	}
+	return nil
+}
+
+// CreateInvoice creates and signs an invoice for <amount> that expires
+// after <validity>, and keeps it in the ledger so that the payment can be
+// matched to it.
+// ----------------------------------------------------------------------------
+// It returns an error in case the node keeps no ledger, since it could not
+// remember the invoice, or the amount is not valid.
+func (node *PeerNode) CreateInvoice(amount Money, memo string, validity time.Duration) (*Invoice, error) {
+	if node.ledger == nil {
+		return nil, fmt.Errorf("this node keeps no ledger, so it cannot keep invoices")
+	}
+	err := node.assets.Validate(amount)
+	if err != nil {
+		return nil, err
+	}
+	if validity <= 0 {
+		return nil, fmt.Errorf("an invoice has to be valid for some time")
+	}
+	id, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	invoice := &Invoice{
+		ID:      id,
+		Payee:   node.advertisedAddress(),
+		Amount:  amount,
+		Memo:    memo,
+		Created: now,
+		Expires: now.Add(validity),
+	}
+	invoice.Signature, invoice.PublicKey, err = node.sign(invoice.signingBytes())
+	if err != nil {
+		return nil, err
+	}
+	err = node.ledger.AddInvoice(invoice)
+	if err != nil {
+		return nil, err
+	}
+	return invoice, nil
+}
+
+// PayInvoice checks <invoice> and pays it to its payee
+func (node *PeerNode) PayInvoice(invoice *Invoice) {
+	err := invoice.Verify()
+	if err != nil {
+		fmt.Println("Payment refused:", err)
+		return
+	}
+	_, err = node.sendPayment(invoice.Payee, invoice.Amount, invoice.ID)
+	if err != nil {
+		fmt.Println("Payment refused:", err)
+	}
+}
+
+// WriteInvoice writes the text form of <invoice> to the file <path>
+func WriteInvoice(path string, invoice *Invoice) error {
+	return ioutil.WriteFile(path, []byte(invoice.Encode()+"\n"), 0644)
+}
+
+// AddInvoice keeps <invoice>, which this node created, as unpaid
+func (ledger *Ledger) AddInvoice(invoice *Invoice) error {
+	data, err := json.Marshal(&InvoiceRecord{Invoice: *invoice})
+	if err != nil {
+		return err
+	}
+	return ledger.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(invoicesBucket).Put([]byte(invoice.ID), data)
+	})
+}
+
+// Invoices returns every invoice this node created, the newest first
+func (ledger *Ledger) Invoices() ([]InvoiceRecord, error) {
+	var records []InvoiceRecord
+	err := ledger.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(invoicesBucket).ForEach(func(key, value []byte) error {
+			var record InvoiceRecord
+			err := json.Unmarshal(value, &record)
+			if err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	// the keys are random, so the invoices are sorted by creation time
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Invoice.Created.After(records[j].Invoice.Created)
+	})
+	return records, err
+}
+
+// matchInvoiceLocked finds the unpaid invoice <transaction> of <peerID>
+// settles.
+// ----------------------------------------------------------------------------
+// it returns the record of the invoice, marked as paid but not written yet,
+// so that the caller only writes it when the payment is booked
+// It returns an <ErrInvoice> in case the invoice does not exist, is paid
+// already, has expired or is for another amount.
+func (ledger *Ledger) matchInvoiceLocked(tx *bolt.Tx, peerID peer.ID, transaction *TransactionWrapper) (*InvoiceRecord, error) {
+	data := tx.Bucket(invoicesBucket).Get([]byte(transaction.Invoice))
+	if data == nil {
+		return nil, &ErrInvoice{ID: transaction.Invoice, Reason: "unknown invoice"}
+	}
+	record := &InvoiceRecord{}
+	err := json.Unmarshal(data, record)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	switch {
+	case record.Paid:
+		return nil, &ErrInvoice{ID: transaction.Invoice, Reason: "paid already by transaction " + record.Transaction}
+	case now.After(record.Invoice.Expires):
+		return nil, &ErrInvoice{ID: transaction.Invoice, Reason: "expired at " + record.Invoice.Expires.Format(time.RFC3339)}
+	case record.Invoice.Amount != transaction.Amount:
+		return nil, &ErrInvoice{ID: transaction.Invoice, Reason: fmt.Sprintf("the invoice is for %s, not %s",
+			ledger.assets.Format(record.Invoice.Amount), ledger.assets.Format(transaction.Amount))}
+	}
+	record.Paid = true
+	record.PaidBy = peer.IDB58Encode(peerID)
+	record.Transaction = transaction.ID
+	record.PaidAt = now
+	return record, nil
+}
+
+// putInvoiceLocked writes <record> back to the database
+func (ledger *Ledger) putInvoiceLocked(tx *bolt.Tx, record *InvoiceRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(invoicesBucket).Put([]byte(record.Invoice.ID), data)
+}
+
+// FormatInvoice writes <record> as one line
+func (ledger *Ledger) FormatInvoice(record InvoiceRecord) string {
+	status := "open"
+	if record.Paid {
+		status = fmt.Sprintf("paid by %s at %s", record.PaidBy, record.PaidAt.Format(time.RFC3339))
+	} else if time.Now().After(record.Invoice.Expires) {
+		status = "expired"
+	}
+	return fmt.Sprintf("%s %s %s %q (%s)", record.Invoice.ID, record.Invoice.Created.Format(time.RFC3339),
+		ledger.assets.Format(record.Invoice.Amount), record.Invoice.Memo, status)
+}
+
+// invoiceFile returns the file name an invoice is written to by default
+func invoiceFile(invoice *Invoice) string {
+	return invoice.ID + ".invoice"
+}
@@ -0,0 +1,148 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// LatencyStats is a struct that holds the round trip time statistics of a
+// peer over the last <Samples> heartbeats.
+// <Jitter> is the average difference between two heartbeats in a row and
+// <EWMA> is the moving average the peerstore keeps.
+type LatencyStats struct {
+	Samples int
+	Min     time.Duration
+	Avg     time.Duration
+	P95     time.Duration
+	Max     time.Duration
+	Jitter  time.Duration
+	EWMA    time.Duration
+}
+
+// String returns <stats> as a line that can be shown in the shell
+func (stats LatencyStats) String() string {
+	return fmt.Sprintf("samples=%d min=%s avg=%s p95=%s max=%s jitter=%s ewma=%s",
+		stats.Samples, stats.Min, stats.Avg, stats.P95, stats.Max, stats.Jitter, stats.EWMA)
+}
+
+// LatencyTracker is a struct that keeps a sliding window of the last round
+// trip times of every peer.
+type LatencyTracker struct {
+	window  int
+	mutex   sync.RWMutex
+	samples map[peer.ID][]time.Duration
+}
+
+// NewLatencyTracker creates a <LatencyTracker> that keeps the last <window>
+// round trip times of every peer.
+func NewLatencyTracker(window int) *LatencyTracker {
+	if window < 1 {
+		window = 1
+	}
+	return &LatencyTracker{
+		window:  window,
+		samples: make(map[peer.ID][]time.Duration),
+	}
+}
+
+// Record adds the round trip time <rtt> of <peerID> to the window. The
+// oldest sample is dropped when the window is full.
+func (tracker *LatencyTracker) Record(peerID peer.ID, rtt time.Duration) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	samples := append(tracker.samples[peerID], rtt)
+	if len(samples) > tracker.window {
+		samples = samples[len(samples)-tracker.window:]
+	}
+	tracker.samples[peerID] = samples
+}
+
+// Stats computes the statistics of <peerID> over the current window.
+// ----------------------------------------------------------------------------
+// it returns false if there is no sample of <peerID> yet
+func (tracker *LatencyTracker) Stats(peerID peer.ID) (LatencyStats, bool) {
+	tracker.mutex.RLock()
+	samples := append([]time.Duration(nil), tracker.samples[peerID]...)
+	tracker.mutex.RUnlock()
+	var stats LatencyStats
+	if len(samples) == 0 {
+		return stats, false
+	}
+	stats.Samples = len(samples)
+	// jitter is computed in the order the samples arrived, before they get
+	// sorted for the percentiles.
+	var total, differences time.Duration
+	for i, sample := range samples {
+		total += sample
+		if i > 0 {
+			differences += absDuration(sample - samples[i-1])
+		}
+	}
+	stats.Avg = total / time.Duration(len(samples))
+	if len(samples) > 1 {
+		stats.Jitter = differences / time.Duration(len(samples)-1)
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	stats.Min = samples[0]
+	stats.Max = samples[len(samples)-1]
+	stats.P95 = samples[int(math.Ceil(0.95*float64(len(samples))))-1]
+	return stats, true
+}
+
+// recordLatency adds a round trip time of <peerID> to the latency tracker of
+// <node> and to the latency metrics of its peerstore.
+func (node *PeerNode) recordLatency(peerID peer.ID, rtt time.Duration) {
+	node.latency.Record(peerID, rtt)
+	node.Peerstore().RecordLatency(peerID, rtt)
+}
+
+// LatencyStats returns the round trip time statistics of <peerID>.
+// ----------------------------------------------------------------------------
+// <node> is a receiver of pointer type to <PeerNode>.
+// <peerID> is the peer we want the statistics of.
+// ----------------------------------------------------------------------------
+// it returns false if no heartbeat was answered by <peerID> yet
+func (node *PeerNode) LatencyStats(peerID peer.ID) (LatencyStats, bool) {
+	stats, ok := node.latency.Stats(peerID)
+	if ok {
+		stats.EWMA = node.Peerstore().LatencyEWMA(peerID)
+	}
+	return stats, ok
+}
+
+// absDuration returns the absolute value of <duration>
+func absDuration(duration time.Duration) time.Duration {
+	if duration < 0 {
+		return -duration
+	}
+	return duration
+}
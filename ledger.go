@@ -0,0 +1,657 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The ledger database has one bucket with the balance of every peer and
+// asset, keyed by <"<peer>/<asset>">, and one bucket with a nested bucket
+// of entries per peer.
+var (
+	accountsBucket = []byte("accounts")
+	entriesBucket  = []byte("entries")
+)
+
+// The receiver of payments keeps the result of every transaction, keyed by
+// <"<sender>/<transaction ID>">, and the last nonce of every sender, so
+// that a transaction is never booked twice.
+var (
+	transactionsBucket = []byte("transactions")
+	noncesBucket       = []byte("nonces")
+)
+
+// The sender of payments keeps the last nonce it used under
+// <lastNonceKey>, so the next one is higher even after the clock went back.
+var (
+	outgoingBucket = []byte("outgoing")
+	lastNonceKey   = []byte("nonce")
+)
+
+// The first version of the ledger kept <float64> balances without an asset
+// in these buckets. They are moved to the default asset when the ledger is
+// opened.
+var (
+	legacyBalancesBucket = []byte("balances")
+	legacyHistoryBucket  = []byte("history")
+)
+
+// ErrCreditLimit is returned when a payment would take a balance past the
+// credit limit
+type ErrCreditLimit struct {
+	Peer    peer.ID
+	Balance string
+	Limit   string
+}
+
+// Error returns the reason of <err> as text
+func (err *ErrCreditLimit) Error() string {
+	return fmt.Sprintf("balance with %s would be %s, the credit limit is %s", err.Peer.Pretty(), err.Balance, err.Limit)
+}
+
+// LedgerEntry is one booking of the ledger. <Amount> is in minor units of
+// <Asset>, positive for money we received (a credit) and negative for
+// money we sent (a debit). <Balance> is the balance with <Peer> in <Asset>
+// after the booking.
+type LedgerEntry struct {
+	Time    time.Time
+	Peer    string
+	Asset   string
+	Amount  int64 `json:",string"`
+	Balance int64 `json:",string"`
+}
+
+// Ledger is a struct that keeps the balance with every counterparty and the
+// history of every booking in an embedded <bbolt> database.
+// The balance with a peer is what they paid us minus what we paid them, per
+// asset. It can go down to minus the credit limit of the asset when we pay
+// them more than they paid us, and up to the limit the other way around,
+// so that neither side owes the other more than the limit.
+type Ledger struct {
+	db           *bolt.DB
+	assets       AssetRegistry
+	creditLimits map[string]int64
+}
+
+// OpenLedger opens the ledger database in <path> and creates it if it does
+// not exist yet.
+// ----------------------------------------------------------------------------
+// <path> is a parameter of string type that is the database file.
+// <assets> is a parameter of <AssetRegistry> type that holds the assets the
+// ledger books.
+// <creditLimits> is a parameter of map type that holds how far a balance
+// can go in either direction per asset, as decimal text such as <"1000">.
+// An asset without a limit cannot be booked at all.
+// <defaultAsset> is the asset old balances without an asset are moved to.
+// ----------------------------------------------------------------------------
+// it returns a pointer to <Ledger> struct
+// It returns an error in case a credit limit is not valid or the database
+// cannot be opened, for example because another node holds it.
+func OpenLedger(path string, assets AssetRegistry, creditLimits map[string]string, defaultAsset string) (*Ledger, error) {
+	ledger := &Ledger{assets: assets, creditLimits: make(map[string]int64)}
+	for asset, text := range creditLimits {
+		decimals, err := assets.Decimals(asset)
+		if err != nil {
+			return nil, fmt.Errorf("credit limit: %s", err)
+		}
+		limit, err := parseUnits(text, decimals)
+		if err != nil {
+			return nil, fmt.Errorf("credit limit of %s: %s", asset, err)
+		}
+		ledger.creditLimits[asset] = limit
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(accountsBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(entriesBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(transactionsBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(noncesBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(outgoingBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(invoicesBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(channelsBucket)
+		if err != nil {
+			return err
+		}
+		return ledger.migrateLocked(tx, defaultAsset)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	ledger.db = db
+	return ledger, nil
+}
+
+// migrateLocked moves the <float64> balances and entries of the first
+// ledger version to <defaultAsset>, rounded to its decimals, and drops the
+// old buckets
+func (ledger *Ledger) migrateLocked(tx *bolt.Tx, defaultAsset string) error {
+	balances := tx.Bucket(legacyBalancesBucket)
+	if balances == nil {
+		return nil
+	}
+	decimals, err := ledger.assets.Decimals(defaultAsset)
+	if err != nil {
+		return fmt.Errorf("cannot move old balances: %s", err)
+	}
+	// <float64> values are turned into minor units by printing them with
+	// the decimals of the asset, which rounds them the way people expect
+	toUnits := func(value float64) (int64, error) {
+		text := strconv.FormatFloat(math.Abs(value), 'f', decimals, 64)
+		units, err := parseUnits(text, decimals)
+		if value < 0 {
+			units = -units
+		}
+		return units, err
+	}
+	accounts := tx.Bucket(accountsBucket)
+	err = balances.ForEach(func(key, value []byte) error {
+		if len(value) != 8 {
+			return nil
+		}
+		units, err := toUnits(math.Float64frombits(binary.BigEndian.Uint64(value)))
+		if err != nil {
+			return err
+		}
+		return accounts.Put(accountKey(string(key), defaultAsset), encodeUnits(units))
+	})
+	if err != nil {
+		return err
+	}
+	if history := tx.Bucket(legacyHistoryBucket); history != nil {
+		err = history.ForEach(func(key, value []byte) error {
+			return history.Bucket(key).ForEach(func(sequence, data []byte) error {
+				var legacy struct {
+					Time    time.Time
+					Peer    string
+					Amount  float64
+					Balance float64
+				}
+				err := json.Unmarshal(data, &legacy)
+				if err != nil {
+					return err
+				}
+				entry := LedgerEntry{Time: legacy.Time, Peer: legacy.Peer, Asset: defaultAsset}
+				entry.Amount, err = toUnits(legacy.Amount)
+				if err != nil {
+					return err
+				}
+				entry.Balance, err = toUnits(legacy.Balance)
+				if err != nil {
+					return err
+				}
+				return ledger.appendEntryLocked(tx, entry)
+			})
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.DeleteBucket(legacyHistoryBucket)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.DeleteBucket(legacyBalancesBucket)
+}
+
+// Close closes the ledger database
+func (ledger *Ledger) Close() error {
+	return ledger.db.Close()
+}
+
+// Credit books <money> we received from <peerID>.
+// ----------------------------------------------------------------------------
+// it returns the new entry of the ledger
+// It returns an <ErrCreditLimit> in case the balance would go past the
+// credit limit and the payment has to be refused.
+func (ledger *Ledger) Credit(peerID peer.ID, money Money) (*LedgerEntry, error) {
+	err := ledger.assets.Validate(money)
+	if err != nil {
+		return nil, err
+	}
+	return ledger.book(peerID, money.Asset, money.Units, true)
+}
+
+// Debit books <money> we paid to <peerID>. It is called once the receiver
+// accepted the payment, so the money is gone and the credit limit is not
+// checked again: another payment could have moved the balance since
+// <CheckDebit>, and refusing to book would only make the ledger wrong.
+// ----------------------------------------------------------------------------
+// it returns the new entry of the ledger
+// It returns an error in case <money> is not valid or the database could
+// not be written.
+func (ledger *Ledger) Debit(peerID peer.ID, money Money) (*LedgerEntry, error) {
+	err := ledger.assets.Validate(money)
+	if err != nil {
+		return nil, err
+	}
+	return ledger.book(peerID, money.Asset, -money.Units, false)
+}
+
+// CheckDebit tells if <money> can be paid to <peerID> without booking it
+func (ledger *Ledger) CheckDebit(peerID peer.ID, money Money) error {
+	err := ledger.assets.Validate(money)
+	if err != nil {
+		return err
+	}
+	return ledger.db.View(func(tx *bolt.Tx) error {
+		_, err := ledger.nextBalanceLocked(tx, peerID, money.Asset, -money.Units)
+		return err
+	})
+}
+
+// nextBalanceLocked returns the balance with <peerID> in <asset> after
+// <amount> is booked.
+// ----------------------------------------------------------------------------
+// It returns an <ErrCreditLimit> in case the balance would go past the
+// credit limit. A booking that brings a balance back towards 0 is always
+// fine, even when the limit was lowered in the meantime. The deposits we
+// locked in payment channels with <peerID> count as paid already for a
+// debit, since the channel can pay them out any time, and the deposits
+// <peerID> locked count as received already for a credit.
+func (ledger *Ledger) nextBalanceLocked(tx *bolt.Tx, peerID peer.ID, asset string, amount int64) (int64, error) {
+	id := peer.IDB58Encode(peerID)
+	previous := decodeUnits(tx.Bucket(accountsBucket).Get(accountKey(id, asset)))
+	balance, err := addUnits(previous, amount)
+	if err != nil {
+		return 0, err
+	}
+	worst, worstPrevious := balance, previous
+	if amount < 0 {
+		locked := ledger.lockedLocked(tx, id, asset)
+		worst, worstPrevious = balance-locked, previous-locked
+	} else if amount > 0 {
+		incoming := ledger.incomingLocked(tx, id, asset)
+		worst, worstPrevious = balance+incoming, previous+incoming
+	}
+	limit := ledger.creditLimits[asset]
+	if absUnits(worst) > limit && absUnits(worst) > absUnits(worstPrevious) {
+		return 0, &ErrCreditLimit{
+			Peer:    peerID,
+			Balance: ledger.assets.Format(Money{Units: worst, Asset: asset}),
+			Limit:   ledger.assets.Format(Money{Units: limit, Asset: asset}),
+		}
+	}
+	return balance, nil
+}
+
+// book changes the balance with <peerID> in <asset> by <amount> and adds an
+// entry to the history. When <limited> is true, the check of the credit
+// limit and both writes happen in one database transaction, so two
+// payments at the same time cannot both slip past the limit.
+func (ledger *Ledger) book(peerID peer.ID, asset string, amount int64, limited bool) (*LedgerEntry, error) {
+	var entry *LedgerEntry
+	err := ledger.db.Update(func(tx *bolt.Tx) error {
+		id := peer.IDB58Encode(peerID)
+		var balance int64
+		var err error
+		if limited {
+			balance, err = ledger.nextBalanceLocked(tx, peerID, asset, amount)
+		} else {
+			balance, err = addUnits(decodeUnits(tx.Bucket(accountsBucket).Get(accountKey(id, asset))), amount)
+		}
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(accountsBucket).Put(accountKey(id, asset), encodeUnits(balance))
+		if err != nil {
+			return err
+		}
+		entry = &LedgerEntry{
+			Time:    time.Now(),
+			Peer:    id,
+			Asset:   asset,
+			Amount:  amount,
+			Balance: balance,
+		}
+		return ledger.appendEntryLocked(tx, *entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// TransactionResult is what the receiver decided about a transaction. It is
+// stored under the ID of the transaction, so a transaction that is sent
+// again gets the same result and is not booked twice.
+// <Entry> is the booking of an accepted transaction and <Code> and
+// <Reason> say why a refused one was refused.
+type TransactionResult struct {
+	ID       string
+	Nonce    uint64
+	Time     time.Time
+	Accepted bool
+	Code     ReceiptCode
+	Reason   string       `json:",omitempty"`
+	Entry    *LedgerEntry `json:",omitempty"`
+	// Duplicate is true when the result was stored already and the
+	// transaction was sent again. It is not stored itself.
+	Duplicate bool `json:"-"`
+}
+
+// Receive books a transaction from <peerID>, which the caller has checked
+// to be signed by <peerID>.
+// ----------------------------------------------------------------------------
+// A transaction whose ID was seen before gets the stored result again. A
+// new transaction has to have a higher nonce than every earlier
+// transaction of <peerID>, otherwise it is a replay or came out of order
+// and is refused without being stored. Everything else is booked as a
+// credit unless it would go past the credit limit or does not settle the
+// invoice it names. The nonce check, the booking, the invoice and the
+// result are written in one database transaction.
+// ----------------------------------------------------------------------------
+// it returns the result of the transaction
+// It returns an error in case the database could not be read or written.
+func (ledger *Ledger) Receive(peerID peer.ID, transaction *TransactionWrapper) (*TransactionResult, error) {
+	id := peer.IDB58Encode(peerID)
+	key := []byte(id + "/" + transaction.ID)
+	var result *TransactionResult
+	err := ledger.db.Update(func(tx *bolt.Tx) error {
+		transactions := tx.Bucket(transactionsBucket)
+		if data := transactions.Get(key); data != nil {
+			result = &TransactionResult{}
+			err := json.Unmarshal(data, result)
+			result.Duplicate = true
+			return err
+		}
+		nonces := tx.Bucket(noncesBucket)
+		last := decodeUnits(nonces.Get([]byte(id)))
+		if transaction.Nonce <= uint64(last) {
+			result = &TransactionResult{
+				ID:     transaction.ID,
+				Nonce:  transaction.Nonce,
+				Time:   time.Now(),
+				Code:   ReceiptReplay,
+				Reason: fmt.Sprintf("nonce %d is not higher than the last nonce %d, the transaction is a replay or out of order", transaction.Nonce, last),
+			}
+			return nil
+		}
+		result = &TransactionResult{ID: transaction.ID, Nonce: transaction.Nonce, Time: time.Now()}
+		err := ledger.assets.Validate(transaction.Amount)
+		var invoice *InvoiceRecord
+		if err == nil && transaction.Invoice != "" {
+			invoice, err = ledger.matchInvoiceLocked(tx, peerID, transaction)
+		}
+		var balance int64
+		if err == nil {
+			balance, err = ledger.nextBalanceLocked(tx, peerID, transaction.Amount.Asset, transaction.Amount.Units)
+		}
+		if err == nil {
+			err = tx.Bucket(accountsBucket).Put(accountKey(id, transaction.Amount.Asset), encodeUnits(balance))
+			if err != nil {
+				return err
+			}
+			result.Accepted = true
+			result.Code = ReceiptAccepted
+			result.Entry = &LedgerEntry{
+				Time:    result.Time,
+				Peer:    id,
+				Asset:   transaction.Amount.Asset,
+				Amount:  transaction.Amount.Units,
+				Balance: balance,
+			}
+			err = ledger.appendEntryLocked(tx, *result.Entry)
+			if err != nil {
+				return err
+			}
+			if invoice != nil {
+				err = ledger.putInvoiceLocked(tx, invoice)
+				if err != nil {
+					return err
+				}
+			}
+		} else {
+			switch err.(type) {
+			case *ErrCreditLimit:
+				result.Code = ReceiptCreditLimit
+			case *ErrInvoice:
+				result.Code = ReceiptInvoice
+			default:
+				result.Code = ReceiptInvalidAmount
+			}
+			result.Reason = err.Error()
+		}
+		err = nonces.Put([]byte(id), encodeUnits(int64(transaction.Nonce)))
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		return transactions.Put(key, data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// NextNonce returns the nonce of the next transaction we send and stores
+// it. It is higher than every nonce returned before and at least <floor>.
+// ----------------------------------------------------------------------------
+// It returns an error in case the database could not be read or written.
+func (ledger *Ledger) NextNonce(floor uint64) (uint64, error) {
+	var nonce uint64
+	err := ledger.db.Update(func(tx *bolt.Tx) error {
+		outgoing := tx.Bucket(outgoingBucket)
+		nonce = uint64(decodeUnits(outgoing.Get(lastNonceKey))) + 1
+		if nonce < floor {
+			nonce = floor
+		}
+		return outgoing.Put(lastNonceKey, encodeUnits(int64(nonce)))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return nonce, nil
+}
+
+// Receipt returns the receipt that is sent back for <result>
+func (result *TransactionResult) Receipt() *TransactionReceipt {
+	receipt := &TransactionReceipt{
+		ID:       result.ID,
+		Accepted: result.Accepted,
+		Code:     result.Code,
+		Reason:   result.Reason,
+		Time:     result.Time,
+	}
+	if result.Entry != nil {
+		receipt.Balance = &Money{Units: result.Entry.Balance, Asset: result.Entry.Asset}
+	}
+	return receipt
+}
+
+// appendEntryLocked adds <entry> to the history of its peer
+func (ledger *Ledger) appendEntryLocked(tx *bolt.Tx, entry LedgerEntry) error {
+	entries, err := tx.Bucket(entriesBucket).CreateBucketIfNotExists([]byte(entry.Peer))
+	if err != nil {
+		return err
+	}
+	sequence, err := entries.NextSequence()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	// big endian keys keep the entries of a peer in booking order
+	sequenceKey := make([]byte, 8)
+	binary.BigEndian.PutUint64(sequenceKey, sequence)
+	return entries.Put(sequenceKey, data)
+}
+
+// Balance returns the balance with <peerID> in <asset>. A peer we never
+// traded with has a balance of 0.
+func (ledger *Ledger) Balance(peerID peer.ID, asset string) (Money, error) {
+	balance := Money{Asset: asset}
+	err := ledger.db.View(func(tx *bolt.Tx) error {
+		balance.Units = decodeUnits(tx.Bucket(accountsBucket).Get(accountKey(peer.IDB58Encode(peerID), asset)))
+		return nil
+	})
+	return balance, err
+}
+
+// Balances returns every balance of the ledger, keyed by base 58 peer ID,
+// or only the balances with <peerID> when it is not empty
+func (ledger *Ledger) Balances(peerID peer.ID) (map[string][]Money, error) {
+	result := make(map[string][]Money)
+	err := ledger.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(accountsBucket).ForEach(func(key, value []byte) error {
+			id, asset := splitAccountKey(key)
+			if peerID != "" && id != peer.IDB58Encode(peerID) {
+				return nil
+			}
+			result[id] = append(result[id], Money{Units: decodeUnits(value), Asset: asset})
+			return nil
+		})
+	})
+	return result, err
+}
+
+// History returns the entries of the ledger with <peerID>, or with every
+// peer when <peerID> is empty, oldest first.
+func (ledger *Ledger) History(peerID peer.ID) ([]LedgerEntry, error) {
+	var result []LedgerEntry
+	err := ledger.db.View(func(tx *bolt.Tx) error {
+		history := tx.Bucket(entriesBucket)
+		visit := func(entries *bolt.Bucket) error {
+			return entries.ForEach(func(key, value []byte) error {
+				var entry LedgerEntry
+				err := json.Unmarshal(value, &entry)
+				if err != nil {
+					return err
+				}
+				result = append(result, entry)
+				return nil
+			})
+		}
+		if peerID != "" {
+			entries := history.Bucket([]byte(peer.IDB58Encode(peerID)))
+			if entries == nil {
+				return nil
+			}
+			return visit(entries)
+		}
+		return history.ForEach(func(key, value []byte) error {
+			return visit(history.Bucket(key))
+		})
+	})
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Time.Before(result[j].Time)
+	})
+	return result, err
+}
+
+// FormatEntry returns <entry> as a line that can be shown in the shell
+func (ledger *Ledger) FormatEntry(entry LedgerEntry) string {
+	kind := "credit"
+	if entry.Amount < 0 {
+		kind = "debit"
+	}
+	return fmt.Sprintf("%s %s %-6s %16s balance %16s", entry.Time.Format(time.RFC3339), entry.Peer, kind,
+		ledger.assets.Format(Money{Units: absUnits(entry.Amount), Asset: entry.Asset}),
+		ledger.assets.Format(Money{Units: entry.Balance, Asset: entry.Asset}))
+}
+
+// accountKey returns the key of the balance with <id> in <asset>
+func accountKey(id string, asset string) []byte {
+	return []byte(id + "/" + asset)
+}
+
+// splitAccountKey returns the peer ID and the asset of an account key
+func splitAccountKey(key []byte) (string, string) {
+	text := string(key)
+	index := strings.LastIndexByte(text, '/')
+	return text[:index], text[index+1:]
+}
+
+// encodeUnits turns a balance into the bytes stored in the database
+func encodeUnits(units int64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(units))
+	return data
+}
+
+// decodeUnits turns the bytes stored in the database into a balance. A
+// missing balance is 0.
+func decodeUnits(data []byte) int64 {
+	if len(data) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(data))
+}
+
+// absUnits returns the absolute value of <units>. The smallest <int64> has
+// no positive counterpart, so it is returned as the largest one.
+func absUnits(units int64) int64 {
+	if units == math.MinInt64 {
+		return math.MaxInt64
+	}
+	if units < 0 {
+		return -units
+	}
+	return units
+}
+
+// Ledger returns the ledger of <node>. It is nil when the node keeps no
+// ledger.
+func (node *PeerNode) Ledger() *Ledger {
+	return node.ledger
+}
@@ -25,24 +25,67 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"math/rand"
-	"strconv"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/abiosoft/ishell"
+	peer "github.com/libp2p/go-libp2p-peer"
 )
 
 func main() {
-	shell()
+	configFile := flag.String("config", defaultConfigFile, "file to read the node settings from")
+	keyFile := flag.String("genkey", "", "write a new private network key to this file and exit")
+	flag.Parse()
+	if *keyFile != "" {
+		err := GeneratePrivateNetworkKey(*keyFile)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Private network key written to %s\n", *keyFile)
+		return
+	}
+	config, err := LoadConfig(*configFile)
+	if err != nil {
+		panic(err)
+	}
+	shell(config)
 
 }
 
-func shell() {
+func shell(config *Config) {
 	fmt.Printf("\nRun Help to see a list of options\n\n")
 	myrand := random(1, 200)
 
-	node := InitializePeer(myrand)
+	node := InitializePeer(myrand, config)
+	// show every state change of the monitored peers as soon as it happens
+	transitions := node.Monitor().Subscribe()
+	go func() {
+		for transition := range transitions {
+			fmt.Println("Heartbeat Monitor:", transition)
+		}
+	}()
+
+	// show every node that joins or leaves the cluster
+	memberships := node.Membership().Subscribe()
+	go func() {
+		for event := range memberships {
+			fmt.Println("Cluster:", event)
+		}
+	}()
+	// show every state change of the presence table
+	presences := node.Presence().Subscribe()
+	go func() {
+		for transition := range presences {
+			fmt.Println("Presence:", transition)
+		}
+	}()
+	node.FailureDetector().OnChange(func(event SuspicionEvent) {
+		fmt.Println("Failure Detector:", event)
+	})
 
 	shell := ishell.New()
 
@@ -70,6 +113,145 @@ func shell() {
 							node.Heartbeat(receiverAddress)
 						},
 					})
+					shellHeartbeatOptions.AddCmd(&ishell.Cmd{
+						Name: "monitor",
+						Help: "keep sending heartbeats to a node and track its state",
+						Func: func(c *ishell.Context) {
+							c.Print("Node Address: ")
+							peerID, err := node.Monitor().Add(c.ReadLine())
+							if err != nil {
+								c.Println(err)
+								return
+							}
+							node.Monitor().Start()
+							c.Printf("Monitoring %s every %s\n", peerID, config.HeartbeatInterval)
+						},
+					})
+					shellHeartbeatOptions.AddCmd(&ishell.Cmd{
+						Name: "unmonitor",
+						Help: "stop monitoring a node",
+						Func: func(c *ishell.Context) {
+							c.Print("Peer ID or Address: ")
+							peerID, err := parsePeerID(c.ReadLine())
+							if err != nil {
+								c.Println(err)
+								return
+							}
+							node.Monitor().Remove(peerID)
+						},
+					})
+					shellHeartbeatOptions.AddCmd(&ishell.Cmd{
+						Name: "watch",
+						Help: "show the live state of the monitored nodes",
+						Func: func(c *ishell.Context) {
+							// the table is redrawn every second until Enter is pressed
+							stop := make(chan struct{})
+							go func() {
+								c.ReadLine()
+								close(stop)
+							}()
+							ticker := time.NewTicker(time.Second)
+							defer ticker.Stop()
+							for {
+								c.ClearScreen()
+								c.Print(FormatPeerStatusTable(node.Monitor().Snapshot()))
+								c.Println("\nRecent transitions:")
+								for _, transition := range node.Monitor().RecentTransitions() {
+									c.Println(" ", transition)
+								}
+								c.Println("\nPress Enter to stop watching")
+								select {
+								case <-stop:
+									return
+								case <-ticker.C:
+								}
+							}
+						},
+					})
+					shellHeartbeatOptions.AddCmd(&ishell.Cmd{
+						Name: "latency",
+						Help: "show round trip time statistics of a node",
+						Func: func(c *ishell.Context) {
+							input := strings.Join(c.Args, " ")
+							if input == "" {
+								c.Print("Peer ID or Address: ")
+								input = c.ReadLine()
+							}
+							peerID, err := parsePeerID(input)
+							if err != nil {
+								c.Println(err)
+								return
+							}
+							stats, ok := node.LatencyStats(peerID)
+							if !ok {
+								c.Println("no heartbeat was answered by", peerID.Pretty(), "yet")
+								return
+							}
+							c.Println(stats)
+						},
+					})
+					shellHeartbeatOptions.AddCmd(&ishell.Cmd{
+						Name: "join",
+						Help: "join a cluster through one or more of its members",
+						Func: func(c *ishell.Context) {
+							addresses := c.Args
+							if len(addresses) == 0 {
+								c.Print("Member Address: ")
+								addresses = []string{c.ReadLine()}
+							}
+							if err := node.Membership().Join(addresses); err != nil {
+								c.Println(err)
+								return
+							}
+							c.Println("Joined the cluster")
+						},
+					})
+					shellHeartbeatOptions.AddCmd(&ishell.Cmd{
+						Name: "create-cluster",
+						Help: "start a new cluster that other nodes can join through this node",
+						Func: func(c *ishell.Context) {
+							node.Membership().Create()
+							c.Println("Created a cluster")
+						},
+					})
+					shellHeartbeatOptions.AddCmd(&ishell.Cmd{
+						Name: "leave",
+						Help: "leave the cluster",
+						Func: func(c *ishell.Context) {
+							node.Membership().Leave()
+							c.Println("Left the cluster")
+						},
+					})
+					shellHeartbeatOptions.AddCmd(&ishell.Cmd{
+						Name: "members",
+						Help: "list the members of the cluster",
+						Func: func(c *ishell.Context) {
+							members := node.Members()
+							if len(members) == 0 {
+								c.Println("no members known")
+								return
+							}
+							for _, member := range members {
+								c.Printf("%s %s incarnation=%d since %s\n", member.ID.Pretty(), member.State, member.Incarnation, member.Since.Format("15:04:05"))
+							}
+						},
+					})
+					shellHeartbeatOptions.AddCmd(&ishell.Cmd{
+						Name: "limits",
+						Help: "show the heartbeat limits and how often they were broken",
+						Func: func(c *ishell.Context) {
+							c.Print(node.HeartbeatLimiter())
+						},
+					})
+					// start monitoring the peers from the config
+					for _, address := range config.MonitoredPeers {
+						if _, err := node.Monitor().Add(address); err != nil {
+							fmt.Println(err)
+						}
+					}
+					if len(config.MonitoredPeers) > 0 {
+						node.Monitor().Start()
+					}
 					shellHeartbeatOptions.Run()
 				}
 			case 1:
@@ -83,15 +265,231 @@ func shell() {
 						Func: func(c *ishell.Context) {
 							c.Print("Receiver Address ")
 							receiverAddress := c.ReadLine()
-							c.Print("Amount? ")
+							c.Printf("Amount? (e.g. 12.50 or 12.50 %s) ", config.DefaultAsset)
 							temp := c.ReadLine()
-							amount, err := strconv.ParseFloat(temp, 64)
+							amount, err := node.Assets().Parse(temp, config.DefaultAsset)
 							if err != nil {
-								panic(err)
+								c.Println(err)
+								return
 							}
 							node.Payment(receiverAddress, amount)
 						},
 					})
+					shellPaymentOptions.AddCmd(&ishell.Cmd{
+						Name: "balance",
+						Help: "show the balance with a node, or with every node: balance [peer]",
+						Func: func(c *ishell.Context) {
+							if node.Ledger() == nil {
+								c.Println("this node keeps no ledger")
+								return
+							}
+							var peerID peer.ID
+							if len(c.Args) > 0 {
+								var err error
+								peerID, err = parsePeerID(c.Args[0])
+								if err != nil {
+									c.Println(err)
+									return
+								}
+							}
+							balances, err := node.Ledger().Balances(peerID)
+							if err != nil {
+								c.Println(err)
+								return
+							}
+							var peers []string
+							for id := range balances {
+								peers = append(peers, id)
+							}
+							sort.Strings(peers)
+							for _, id := range peers {
+								for _, balance := range balances[id] {
+									c.Printf("%s %s\n", id, node.Assets().Format(balance))
+								}
+							}
+						},
+					})
+					shellPaymentOptions.AddCmd(&ishell.Cmd{
+						Name: "history",
+						Help: "show the ledger entries with a node, or with every node: history [peer]",
+						Func: func(c *ishell.Context) {
+							if node.Ledger() == nil {
+								c.Println("this node keeps no ledger")
+								return
+							}
+							var peerID peer.ID
+							if len(c.Args) > 0 {
+								var err error
+								peerID, err = parsePeerID(c.Args[0])
+								if err != nil {
+									c.Println(err)
+									return
+								}
+							}
+							entries, err := node.Ledger().History(peerID)
+							if err != nil {
+								c.Println(err)
+								return
+							}
+							for _, entry := range entries {
+								c.Println(node.Ledger().FormatEntry(entry))
+							}
+						},
+					})
+					shellPaymentOptions.AddCmd(&ishell.Cmd{
+						Name: "invoice",
+						Help: "ask a node to pay us, and write the invoice to a file: invoice [file]",
+						Func: func(c *ishell.Context) {
+							c.Printf("Amount? (e.g. 12.50 or 12.50 %s) ", config.DefaultAsset)
+							amount, err := node.Assets().Parse(c.ReadLine(), config.DefaultAsset)
+							if err != nil {
+								c.Println(err)
+								return
+							}
+							c.Print("Memo? ")
+							memo := c.ReadLine()
+							c.Print("Valid for? (default 24h) ")
+							validity := 24 * time.Hour
+							if text := strings.TrimSpace(c.ReadLine()); text != "" {
+								validity, err = time.ParseDuration(text)
+								if err != nil {
+									c.Println(err)
+									return
+								}
+							}
+							invoice, err := node.CreateInvoice(amount, memo, validity)
+							if err != nil {
+								c.Println(err)
+								return
+							}
+							file := invoiceFile(invoice)
+							if len(c.Args) > 0 {
+								file = c.Args[0]
+							}
+							c.Printf("Invoice %s:\n%s\n", invoice.ID, invoice.Encode())
+							err = WriteInvoice(file, invoice)
+							if err != nil {
+								c.Println(err)
+								return
+							}
+							c.Printf("Written to %s\n", file)
+						},
+					})
+					shellPaymentOptions.AddCmd(&ishell.Cmd{
+						Name: "invoices",
+						Help: "list the invoices this node created",
+						Func: func(c *ishell.Context) {
+							if node.Ledger() == nil {
+								c.Println("this node keeps no ledger")
+								return
+							}
+							records, err := node.Ledger().Invoices()
+							if err != nil {
+								c.Println(err)
+								return
+							}
+							for _, record := range records {
+								c.Println(node.Ledger().FormatInvoice(record))
+							}
+						},
+					})
+					shellPaymentOptions.AddCmd(&ishell.Cmd{
+						Name: "pay-invoice",
+						Help: "pay an invoice, given as text or as a file: pay-invoice <invoice>",
+						Func: func(c *ishell.Context) {
+							if len(c.Args) != 1 {
+								c.Println("usage: pay-invoice <invoice>")
+								return
+							}
+							invoice, err := DecodeInvoice(c.Args[0])
+							if err != nil {
+								c.Println(err)
+								return
+							}
+							c.Printf("Paying %s to %s", node.Assets().Format(invoice.Amount), invoice.Payee)
+							if invoice.Memo != "" {
+								c.Printf(" for %q", invoice.Memo)
+							}
+							c.Println()
+							node.PayInvoice(invoice)
+						},
+					})
+					shellPaymentOptions.AddCmd(&ishell.Cmd{
+						Name: "channel",
+						Help: "payment channels: channel open | pay <id> | close <id> [--force] | list",
+						Func: func(c *ishell.Context) {
+							if node.Ledger() == nil {
+								c.Println("this node keeps no ledger")
+								return
+							}
+							command := "list"
+							if len(c.Args) > 0 {
+								command = c.Args[0]
+							}
+							switch {
+							case command == "open":
+								c.Print("Receiver Address ")
+								receiverAddress := c.ReadLine()
+								c.Printf("Our deposit? (e.g. 12.50 or 12.50 %s) ", config.DefaultAsset)
+								deposit, err := node.Assets().ParseDeposit(c.ReadLine(), config.DefaultAsset)
+								if err != nil {
+									c.Println(err)
+									return
+								}
+								c.Printf("Their deposit? (default 0 %s) ", deposit.Asset)
+								peerDeposit := Money{Asset: deposit.Asset}
+								if text := strings.TrimSpace(c.ReadLine()); text != "" {
+									peerDeposit, err = node.Assets().ParseDeposit(text, deposit.Asset)
+									if err != nil {
+										c.Println(err)
+										return
+									}
+								}
+								record, err := node.OpenChannel(receiverAddress, deposit, peerDeposit)
+								if err != nil {
+									c.Println(err)
+									return
+								}
+								c.Println(node.Ledger().FormatChannel(*record))
+							case command == "pay" && len(c.Args) == 2:
+								record, err := node.Ledger().Channel(c.Args[1])
+								if err != nil {
+									c.Println(err)
+									return
+								}
+								c.Printf("Amount? (in %s) ", record.State.Asset)
+								amount, err := node.Assets().Parse(c.ReadLine(), record.State.Asset)
+								if err != nil {
+									c.Println(err)
+									return
+								}
+								state, err := node.ChannelPay(c.Args[1], amount)
+								if err != nil {
+									c.Println(err)
+									return
+								}
+								c.Printf("Channel %s at state %d\n", state.Channel, state.Sequence)
+							case command == "close" && (len(c.Args) == 2 || (len(c.Args) == 3 && c.Args[2] == "--force")):
+								record, err := node.CloseChannel(c.Args[1], len(c.Args) == 3)
+								if err != nil {
+									c.Println(err)
+									return
+								}
+								c.Println(node.Ledger().FormatChannel(*record))
+							case command == "list":
+								records, err := node.Ledger().Channels()
+								if err != nil {
+									c.Println(err)
+									return
+								}
+								for _, record := range records {
+									c.Println(node.Ledger().FormatChannel(record))
+								}
+							default:
+								c.Println("usage: channel open | pay <id> | close <id> [--force] | list")
+							}
+						},
+					})
 					shellPaymentOptions.Run()
 				}
 			case 2:
@@ -115,6 +513,204 @@ func shell() {
 			}
 		},
 	})
+	shell.AddCmd(&ishell.Cmd{
+		Name: "acl",
+		Help: "show or edit the access control lists",
+		Func: func(c *ishell.Context) {
+			choice := c.MultiChoice([]string{
+				"Show rules",
+				"Allow peer",
+				"Deny peer",
+				"Allow CIDR range",
+				"Deny CIDR range",
+				"Restrict protocol to peer",
+				"Open protocol to everyone",
+				"Remove peer or CIDR range",
+			}, "What do you want to do?")
+			var err error
+			switch choice {
+			case 0:
+				c.Println(node.gater)
+				return
+			case 1, 2, 5:
+				c.Print("Peer ID or Address: ")
+				id, parseErr := parsePeerID(c.ReadLine())
+				if parseErr != nil {
+					c.Println(parseErr)
+					return
+				}
+				switch choice {
+				case 1:
+					err = node.gater.AllowPeer(id)
+				case 2:
+					err = node.gater.DenyPeer(id)
+				case 5:
+					c.Print("Protocol (e.g. /sync/1.0.0): ")
+					err = node.gater.RestrictProtocol(c.ReadLine(), id)
+				}
+			case 3:
+				c.Print("CIDR range: ")
+				err = node.gater.AllowCIDR(c.ReadLine())
+			case 4:
+				c.Print("CIDR range: ")
+				err = node.gater.DenyCIDR(c.ReadLine())
+			case 6:
+				c.Print("Protocol (e.g. /sync/1.0.0): ")
+				err = node.gater.OpenProtocol(c.ReadLine())
+			case 7:
+				c.Print("Peer ID or CIDR range: ")
+				err = node.gater.Remove(c.ReadLine())
+			default:
+				return
+			}
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			// drop the connections that the new rules do not allow anymore
+			node.enforceAccessControl()
+			c.Println("Access control lists saved to", config.ACLFile)
+		},
+	})
+	shell.AddCmd(&ishell.Cmd{
+		Name: "relay",
+		Help: "reserve a slot on a relay node so that peers behind NAT can reach this node",
+		Func: func(c *ishell.Context) {
+			c.Print("Relay Address: ")
+			relayAddress := c.ReadLine()
+			circuitAddress, err := node.ReserveRelay(relayAddress)
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			c.Println("This node is now reachable at", circuitAddress)
+		},
+	})
+	shell.AddCmd(&ishell.Cmd{
+		Name: "relay-demo",
+		Help: "run heartbeat, payment and sync between three local nodes through a relay",
+		Func: func(c *ishell.Context) {
+			err := RelayDemo(config)
+			if err != nil {
+				c.Println("Relay demo failed:", err)
+			}
+		},
+	})
+	shell.AddCmd(&ishell.Cmd{
+		Name: "reachability",
+		Help: "ask helper peers to dial back and report which of our addresses are reachable",
+		Func: func(c *ishell.Context) {
+			c.Print("Helper Addresses (comma separated, empty for the config or connected peers): ")
+			helpers := config.ReachabilityHelpers
+			if input := strings.TrimSpace(c.ReadLine()); input != "" {
+				helpers = nil
+				for _, helper := range strings.Split(input, ",") {
+					helpers = append(helpers, strings.TrimSpace(helper))
+				}
+			}
+			for _, checked := range node.CheckReachability(helpers) {
+				c.Printf("%-10s %s\n", checked.Reachability, checked.Address)
+			}
+			c.Println("Advertised Address:", node.advertisedAddress())
+		},
+	})
+	shell.AddCmd(&ishell.Cmd{
+		Name: "ws-check",
+		Help: "run heartbeat, payment and sync against this node over WebSocket on loopback",
+		Func: func(c *ishell.Context) {
+			err := node.WebSocketCheck(config)
+			if err != nil {
+				c.Println("WebSocket check failed:", err)
+			}
+		},
+	})
+	shell.AddCmd(&ishell.Cmd{
+		Name: "uptime",
+		Help: "availability and outages of a node: uptime <peer> [--since 24h]",
+		Func: func(c *ishell.Context) {
+			if node.History() == nil {
+				c.Println("the heartbeat history is turned off")
+				return
+			}
+			peerID, since, err := parseUptimeArgs(c.Args)
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			report, err := node.History().Uptime(peerID, time.Now().Add(-since))
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			c.Print(report)
+		},
+	})
+	shell.AddCmd(&ishell.Cmd{
+		Name: "topology",
+		Help: "map who can reach whom and export it: topology [name], writes name.dot and name.json",
+		Func: func(c *ishell.Context) {
+			name := "topology"
+			if len(c.Args) > 0 {
+				name = c.Args[0]
+			}
+			graph := node.Topology()
+			c.Print(graph)
+			if err := graph.Export(name); err != nil {
+				c.Println(err)
+				return
+			}
+			c.Printf("Written to %s.dot and %s.json\n", name, name)
+		},
+	})
+	shell.AddCmd(&ishell.Cmd{
+		Name: "presence",
+		Help: "heartbeats over pubsub: presence start | stop | table",
+		Func: func(c *ishell.Context) {
+			command := "table"
+			if len(c.Args) > 0 {
+				command = c.Args[0]
+			}
+			switch command {
+			case "start":
+				if err := node.Presence().Start(); err != nil {
+					c.Println(err)
+					return
+				}
+				c.Printf("Publishing presence every %s\n", config.PresenceInterval)
+			case "stop":
+				node.Presence().Stop()
+				c.Println("Stopped publishing presence")
+			case "table":
+				if !node.Presence().Active() {
+					c.Println("presence is not running, type 'presence start'")
+				}
+				c.Print(FormatPeerStatusTable(node.Presence().Snapshot()))
+			default:
+				c.Println("usage: presence start | stop | table")
+			}
+		},
+	})
+	shell.AddCmd(&ishell.Cmd{
+		Name: "receipt",
+		Help: "check a proof of payment: receipt verify <file>",
+		Func: func(c *ishell.Context) {
+			if len(c.Args) != 2 || c.Args[0] != "verify" {
+				c.Println("usage: receipt verify <file>")
+				return
+			}
+			proof, err := LoadProofOfPayment(c.Args[1])
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			err = proof.Verify()
+			if err != nil {
+				c.Println("INVALID:", err)
+				return
+			}
+			c.Println("VALID:", proof.Describe(node.Assets()))
+		},
+	})
 	shell.Run()
 }
 func random(min, max int) int {
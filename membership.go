@@ -0,0 +1,729 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	multiaddr "github.com/multiformats/go-multiaddr"
+)
+
+// maxGossipPerMessage is the largest number of membership updates that are
+// piggybacked on a single heartbeat message
+const maxGossipPerMessage = 8
+
+// gossipRetransmitMultiplier decides how many times an update is
+// piggybacked: <gossipRetransmitMultiplier> * log(number of members + 1).
+// That is enough for an update to reach every member with high probability.
+const gossipRetransmitMultiplier = 3
+
+// MemberState is the state a member of the cluster is in
+type MemberState int
+
+const (
+	// MemberAlive means the member answers probes
+	MemberAlive MemberState = iota
+	// MemberSuspect means a probe of the member failed and nobody has
+	// proven it is alive since
+	MemberSuspect
+	// MemberDead means the member stayed suspect for too long
+	MemberDead
+	// MemberLeft means the member left the cluster on purpose
+	MemberLeft
+)
+
+// String returns the name of <state> as it is shown in the shell
+func (state MemberState) String() string {
+	switch state {
+	case MemberAlive:
+		return "alive"
+	case MemberSuspect:
+		return "suspect"
+	case MemberDead:
+		return "dead"
+	case MemberLeft:
+		return "left"
+	default:
+		return "unknown"
+	}
+}
+
+// MemberUpdate is the membership information that is piggybacked on
+// <"/heartbeat/2.0.0"> messages. <ID> is the base 58 peer ID and <Addrs> are
+// the multiaddresses of the member without the peer ID.
+// <Incarnation> is raised by a member every time it has to prove it is alive,
+// so newer news about a member always wins over older news.
+type MemberUpdate struct {
+	ID          string
+	Addrs       []string
+	State       MemberState
+	Incarnation uint64
+}
+
+// Member is a struct that holds what we know about one member of the cluster
+type Member struct {
+	ID          peer.ID
+	Addrs       []string
+	State       MemberState
+	Incarnation uint64
+	Since       time.Time
+}
+
+// MembershipEventKind tells what happened to a member
+type MembershipEventKind int
+
+const (
+	// MemberJoined is sent when a member is seen for the first time, or
+	// comes back after it was dead or left
+	MemberJoined MembershipEventKind = iota
+	// MemberSuspected is sent when a member becomes suspect
+	MemberSuspected
+	// MemberRecovered is sent when a suspect member proves it is alive
+	MemberRecovered
+	// MemberFailed is sent when a member is declared dead
+	MemberFailed
+	// MemberDeparted is sent when a member leaves the cluster
+	MemberDeparted
+)
+
+// String returns the name of <kind> as it is shown in the shell
+func (kind MembershipEventKind) String() string {
+	switch kind {
+	case MemberJoined:
+		return "joined"
+	case MemberSuspected:
+		return "suspected"
+	case MemberRecovered:
+		return "recovered"
+	case MemberFailed:
+		return "failed"
+	case MemberDeparted:
+		return "left"
+	default:
+		return "unknown"
+	}
+}
+
+// MembershipEvent is sent to subscribers every time a member changes state
+type MembershipEvent struct {
+	Kind   MembershipEventKind
+	Member Member
+	Time   time.Time
+}
+
+// String returns <event> as a line that can be shown in the shell
+func (event MembershipEvent) String() string {
+	return fmt.Sprintf("%s %s %s", event.Time.Format("15:04:05"), event.Member.ID, event.Kind)
+}
+
+// queuedUpdate is an update that waits to be piggybacked, together with the
+// number of times it was sent already
+type queuedUpdate struct {
+	update    MemberUpdate
+	transmits int
+}
+
+// Membership is a struct that keeps track of the members of a cluster with
+// the SWIM protocol:
+// every <ProbeInterval> one member is probed with a heartbeat. If it does
+// not answer, <IndirectProbes> random members are asked to probe it for us.
+// If nobody reaches it, it becomes suspect, and if it does not refute that
+// within <SuspicionTimeout>, it is declared dead.
+// What a node learns is piggybacked on the heartbeats it sends and answers,
+// so news spreads through the cluster without extra messages.
+type Membership struct {
+	node             *PeerNode
+	probeInterval    time.Duration
+	probeTimeout     time.Duration
+	suspicionTimeout time.Duration
+	indirectProbes   int
+
+	mutex       sync.RWMutex
+	members     map[peer.ID]*Member
+	incarnation uint64
+	queue       []*queuedUpdate
+	probeOrder  []peer.ID
+	subscribers []chan MembershipEvent
+	stop        chan struct{}
+}
+
+// memberAddrTTL is how long the addresses of a member stay in the address
+// book. They are only added right before the member is probed, never when
+// gossip about it arrives, so only addresses of members that went away
+// expire.
+const memberAddrTTL = 10 * time.Minute
+
+// NewMembership creates the cluster membership of <node> with the probe
+// settings of <config>. <node> is not part of a cluster until it creates
+// one or joins one.
+func NewMembership(node *PeerNode, config *Config) *Membership {
+	return &Membership{
+		node:             node,
+		probeInterval:    config.ProbeInterval.Duration,
+		probeTimeout:     config.ProbeTimeout.Duration,
+		suspicionTimeout: config.SuspicionTimeout.Duration,
+		indirectProbes:   config.IndirectProbes,
+		members:          make(map[peer.ID]*Member),
+	}
+}
+
+// Active reports whether <node> is part of a cluster
+func (membership *Membership) Active() bool {
+	membership.mutex.RLock()
+	defer membership.mutex.RUnlock()
+	return membership.stop != nil
+}
+
+// start starts probing members in the background. It does nothing if the
+// node is part of a cluster already.
+func (membership *Membership) start() {
+	membership.mutex.Lock()
+	defer membership.mutex.Unlock()
+	if membership.stop != nil {
+		return
+	}
+	membership.stop = make(chan struct{})
+	go membership.run(membership.stop)
+}
+
+// Create starts a new cluster with <node> as its only member. Other nodes
+// join it through <node>. A node only lets other nodes join through it once
+// it is part of a cluster, so a peer cannot pull it into one.
+func (membership *Membership) Create() {
+	membership.start()
+}
+
+// Join joins the cluster through the nodes at <addresses>. One of them has to
+// answer, and it sends back every member it knows. A node that is not part
+// of a cluster sends back nothing and does not count.
+// ----------------------------------------------------------------------------
+// <addresses> is a parameter of array of strings type that holds the IPFS
+// addresses of members of the cluster.
+// ----------------------------------------------------------------------------
+// It returns an error in case none of the nodes could be reached.
+func (membership *Membership) Join(addresses []string) error {
+	membership.start()
+	var lastErr error
+	joined := false
+	for _, address := range addresses {
+		peerID, err := addAddressToPeerstore(membership.node, address)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), defaultHeartbeatTimeout)
+		result, err := membership.node.sendHeartbeatWith(ctx, peerID, func(request *HeartbeatRequest) {
+			request.Join = true
+			request.Gossip = append(request.Gossip, membership.announcement())
+		})
+		cancel()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if result.Response == nil || len(result.Response.Gossip) == 0 {
+			lastErr = fmt.Errorf("%s is not part of a cluster", peerID.Pretty())
+			continue
+		}
+		joined = true
+	}
+	if !joined {
+		return fmt.Errorf("could not join the cluster: %s", lastErr)
+	}
+	return nil
+}
+
+// Leave tells every member that <node> leaves the cluster and stops probing.
+func (membership *Membership) Leave() {
+	membership.mutex.Lock()
+	if membership.stop == nil {
+		membership.mutex.Unlock()
+		return
+	}
+	close(membership.stop)
+	membership.stop = nil
+	membership.incarnation = nextIncarnation(membership.incarnation)
+	leave := membership.selfUpdate(MemberLeft)
+	var peerIDs []peer.ID
+	for peerID, member := range membership.members {
+		if member.State == MemberAlive || member.State == MemberSuspect {
+			peerIDs = append(peerIDs, peerID)
+		}
+	}
+	membership.members = make(map[peer.ID]*Member)
+	membership.queue = nil
+	membership.mutex.Unlock()
+	// the goodbye is sent to every member directly, since we will not be
+	// around to piggyback it
+	var wait sync.WaitGroup
+	for _, peerID := range peerIDs {
+		wait.Add(1)
+		go func(peerID peer.ID) {
+			defer wait.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), membership.probeTimeout)
+			defer cancel()
+			membership.node.sendHeartbeatWith(ctx, peerID, func(request *HeartbeatRequest) {
+				request.Gossip = []MemberUpdate{leave}
+			})
+		}(peerID)
+	}
+	wait.Wait()
+}
+
+// Members returns every known member of the cluster, sorted by peer ID.
+// <node> itself is not in the list.
+func (membership *Membership) Members() []Member {
+	membership.mutex.RLock()
+	defer membership.mutex.RUnlock()
+	var result []Member
+	for _, member := range membership.members {
+		result = append(result, *member)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// Subscribe returns a channel that receives every membership event from now
+// on. Slow readers miss events instead of blocking the protocol.
+func (membership *Membership) Subscribe() <-chan MembershipEvent {
+	membership.mutex.Lock()
+	defer membership.mutex.Unlock()
+	subscriber := make(chan MembershipEvent, 64)
+	membership.subscribers = append(membership.subscribers, subscriber)
+	return subscriber
+}
+
+// run probes one member every <probeInterval> until <stop> is closed
+func (membership *Membership) run(stop chan struct{}) {
+	ticker := time.NewTicker(membership.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			membership.expireSuspects()
+			if target, ok := membership.nextTarget(); ok {
+				membership.probe(target)
+			}
+		}
+	}
+}
+
+// nextTarget returns the next member to probe. Members are probed in a
+// random order that is shuffled again after every round, so every member is
+// probed once per round.
+func (membership *Membership) nextTarget() (peer.ID, bool) {
+	membership.mutex.Lock()
+	defer membership.mutex.Unlock()
+	for len(membership.probeOrder) > 0 {
+		target := membership.probeOrder[0]
+		membership.probeOrder = membership.probeOrder[1:]
+		if member, ok := membership.members[target]; ok && (member.State == MemberAlive || member.State == MemberSuspect) {
+			return target, true
+		}
+	}
+	for peerID, member := range membership.members {
+		if member.State == MemberAlive || member.State == MemberSuspect {
+			membership.probeOrder = append(membership.probeOrder, peerID)
+		}
+	}
+	if len(membership.probeOrder) == 0 {
+		return "", false
+	}
+	rand.Shuffle(len(membership.probeOrder), func(i, j int) {
+		membership.probeOrder[i], membership.probeOrder[j] = membership.probeOrder[j], membership.probeOrder[i]
+	})
+	target := membership.probeOrder[0]
+	membership.probeOrder = membership.probeOrder[1:]
+	return target, true
+}
+
+// probe checks <target> directly and, if that fails, through up to
+// <indirectProbes> other members. If nobody reaches it, it becomes suspect.
+func (membership *Membership) probe(target peer.ID) {
+	// the addresses of a member expire unless they are refreshed
+	membership.addAddrs(target, membership.addrsOf(target))
+	ctx, cancel := context.WithTimeout(context.Background(), membership.probeTimeout)
+	// members speak <"/heartbeat/2.0.0">, so an answer is always signed
+	_, err := membership.node.sendHeartbeatWith(ctx, target, nil)
+	cancel()
+	if err == nil {
+		return
+	}
+	helpers := membership.randomMembers(membership.indirectProbes, target)
+	acks := make(chan bool, len(helpers))
+	for _, helper := range helpers {
+		go func(helper peer.ID) {
+			// the helper needs up to <probeTimeout> to probe the target,
+			// so it gets twice as long to answer
+			ctx, cancel := context.WithTimeout(context.Background(), 2*membership.probeTimeout)
+			defer cancel()
+			result, err := membership.node.sendHeartbeatWith(ctx, helper, func(request *HeartbeatRequest) {
+				request.ProbeTarget = target.Pretty()
+				request.ProbeAddrs = membership.addrsOf(target)
+			})
+			acks <- err == nil && result.Response.ProbeAck
+		}(helper)
+	}
+	for range helpers {
+		if <-acks {
+			return
+		}
+	}
+	membership.suspect(target)
+}
+
+// randomMembers returns up to <count> random alive members that are not
+// <exclude>
+func (membership *Membership) randomMembers(count int, exclude peer.ID) []peer.ID {
+	membership.mutex.RLock()
+	defer membership.mutex.RUnlock()
+	var candidates []peer.ID
+	for peerID, member := range membership.members {
+		if peerID != exclude && member.State == MemberAlive {
+			candidates = append(candidates, peerID)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > count {
+		candidates = candidates[:count]
+	}
+	return candidates
+}
+
+// addrsOf returns the addresses we know of <peerID>
+func (membership *Membership) addrsOf(peerID peer.ID) []string {
+	membership.mutex.RLock()
+	defer membership.mutex.RUnlock()
+	if member, ok := membership.members[peerID]; ok {
+		return member.Addrs
+	}
+	return nil
+}
+
+// probeFor probes <target> on behalf of <requester>, a member that could not
+// reach it. Both have to be members we know, so that peers outside the
+// cluster cannot make us dial whatever they like. <addrs> are ignored, the
+// target is dialed at the addresses we know of it.
+// ----------------------------------------------------------------------------
+// it returns true if <target> answered
+func (membership *Membership) probeFor(requester peer.ID, target string) bool {
+	targetID, err := peer.IDB58Decode(target)
+	if err != nil || !membership.Active() {
+		return false
+	}
+	membership.mutex.RLock()
+	_, knownRequester := membership.members[requester]
+	member, knownTarget := membership.members[targetID]
+	var addrs []string
+	if knownTarget {
+		addrs = member.Addrs
+	}
+	membership.mutex.RUnlock()
+	if !knownRequester || !knownTarget {
+		return false
+	}
+	membership.addAddrs(targetID, addrs)
+	ctx, cancel := context.WithTimeout(context.Background(), membership.probeTimeout)
+	defer cancel()
+	_, err = membership.node.sendHeartbeatWith(ctx, targetID, nil)
+	return err == nil
+}
+
+// suspect marks <target> as suspect and gossips about it
+func (membership *Membership) suspect(target peer.ID) {
+	membership.mutex.Lock()
+	defer membership.mutex.Unlock()
+	member, ok := membership.members[target]
+	if !ok || member.State != MemberAlive {
+		return
+	}
+	membership.setState(member, MemberSuspect, member.Incarnation)
+	membership.enqueue(membership.updateOf(member))
+}
+
+// expireSuspects declares every member dead that stayed suspect for longer
+// than <suspicionTimeout>
+func (membership *Membership) expireSuspects() {
+	membership.mutex.Lock()
+	defer membership.mutex.Unlock()
+	for _, member := range membership.members {
+		if member.State == MemberSuspect && time.Since(member.Since) > membership.suspicionTimeout {
+			membership.setState(member, MemberDead, member.Incarnation)
+			membership.enqueue(membership.updateOf(member))
+		}
+	}
+}
+
+// gossip returns the updates that are piggybacked on the next message.
+// Updates that were sent often enough are dropped from the queue.
+// ----------------------------------------------------------------------------
+// <full> asks for every known member instead, which is what a joining node
+// gets.
+func (membership *Membership) gossip(full bool) []MemberUpdate {
+	membership.mutex.Lock()
+	defer membership.mutex.Unlock()
+	if membership.stop == nil {
+		return nil
+	}
+	if full {
+		result := []MemberUpdate{membership.selfUpdate(MemberAlive)}
+		for _, member := range membership.members {
+			result = append(result, membership.updateOf(member))
+		}
+		return result
+	}
+	// updates that were sent the least go first
+	sort.SliceStable(membership.queue, func(i, j int) bool {
+		return membership.queue[i].transmits < membership.queue[j].transmits
+	})
+	limit := int(math.Ceil(gossipRetransmitMultiplier * math.Log(float64(len(membership.members)+2))))
+	var result []MemberUpdate
+	var kept []*queuedUpdate
+	for _, queued := range membership.queue {
+		if len(result) < maxGossipPerMessage {
+			result = append(result, queued.update)
+			queued.transmits++
+		}
+		if queued.transmits < limit {
+			kept = append(kept, queued)
+		}
+	}
+	membership.queue = kept
+	return result
+}
+
+// apply merges <updates> that came with a heartbeat from <from> into what we
+// know. A node that is not part of a cluster ignores them, even with a join
+// request. Gossip is only accepted from current members, so a peer outside
+// the cluster cannot add members or declare them dead. The addresses in the
+// updates are kept with the members, they are not added to the address book.
+// ----------------------------------------------------------------------------
+// <join> is set when the heartbeat is part of a join. Then the update <from>
+// sends about itself makes it a member first, which lets a node join
+// through us and lets us take the member list of the node we join through.
+func (membership *Membership) apply(from peer.ID, updates []MemberUpdate, join bool) {
+	if !membership.Active() {
+		return
+	}
+	membership.mutex.Lock()
+	defer membership.mutex.Unlock()
+	if join {
+		for _, update := range updates {
+			if update.ID == from.Pretty() && update.State == MemberAlive {
+				membership.applyLocked([]MemberUpdate{update})
+			}
+		}
+	}
+	member, known := membership.members[from]
+	if !known || (member.State != MemberAlive && member.State != MemberSuspect) {
+		return
+	}
+	membership.applyLocked(updates)
+}
+
+// applyLocked merges <updates> into what we know. It must be called with the
+// lock held.
+func (membership *Membership) applyLocked(updates []MemberUpdate) {
+	self := membership.node.ID()
+	for _, update := range updates {
+		peerID, err := peer.IDB58Decode(update.ID)
+		if err != nil {
+			continue
+		}
+		if peerID == self {
+			// somebody thinks we are suspect or dead: refute it with a higher
+			// incarnation number
+			if (update.State == MemberSuspect || update.State == MemberDead) && update.Incarnation >= membership.incarnation {
+				membership.incarnation = nextIncarnation(update.Incarnation)
+				membership.enqueue(membership.selfUpdate(MemberAlive))
+			}
+			continue
+		}
+		member, known := membership.members[peerID]
+		if !known {
+			// news about members we never heard of is only useful if
+			// they are alive
+			if update.State != MemberAlive {
+				continue
+			}
+			member = &Member{ID: peerID, Addrs: update.Addrs}
+			membership.members[peerID] = member
+			membership.setState(member, update.State, update.Incarnation)
+			membership.enqueue(update)
+			continue
+		}
+		if !newerUpdate(member, update) {
+			continue
+		}
+		if len(update.Addrs) > 0 {
+			member.Addrs = update.Addrs
+		}
+		membership.setState(member, update.State, update.Incarnation)
+		membership.enqueue(update)
+	}
+}
+
+// nextIncarnation returns the incarnation number after <incarnation>. It
+// stays at the largest number instead of wrapping around to 0, which would
+// make every older update win.
+func nextIncarnation(incarnation uint64) uint64 {
+	if incarnation == math.MaxUint64 {
+		return incarnation
+	}
+	return incarnation + 1
+}
+
+// newerUpdate checks if <update> overrides what we know about <member>.
+// A higher incarnation always wins. With the same incarnation, suspect beats
+// alive, and dead or left beat everything.
+func newerUpdate(member *Member, update MemberUpdate) bool {
+	if update.Incarnation != member.Incarnation {
+		return update.Incarnation > member.Incarnation
+	}
+	return update.State > member.State
+}
+
+// setState changes the state of <member> and sends the matching event.
+// It must be called with the lock held.
+func (membership *Membership) setState(member *Member, state MemberState, incarnation uint64) {
+	previous := member.State
+	// a member that was just created has no state change time yet
+	fresh := member.Since.IsZero()
+	member.Incarnation = incarnation
+	if state == previous && !fresh {
+		return
+	}
+	member.State = state
+	member.Since = time.Now()
+	var kind MembershipEventKind
+	switch {
+	case state == MemberAlive && (fresh || previous == MemberDead || previous == MemberLeft):
+		kind = MemberJoined
+	case state == MemberAlive:
+		kind = MemberRecovered
+	case state == MemberSuspect:
+		kind = MemberSuspected
+	case state == MemberDead:
+		kind = MemberFailed
+	default:
+		kind = MemberDeparted
+	}
+	event := MembershipEvent{Kind: kind, Member: *member, Time: member.Since}
+	for _, subscriber := range membership.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+// enqueue adds <update> to the updates that are piggybacked. An older update
+// about the same member is replaced. It must be called with the lock held.
+func (membership *Membership) enqueue(update MemberUpdate) {
+	for _, queued := range membership.queue {
+		if queued.update.ID == update.ID {
+			queued.update = update
+			queued.transmits = 0
+			return
+		}
+	}
+	membership.queue = append(membership.queue, &queuedUpdate{update: update})
+}
+
+// updateOf turns <member> into an update. It must be called with the lock
+// held.
+func (membership *Membership) updateOf(member *Member) MemberUpdate {
+	return MemberUpdate{
+		ID:          member.ID.Pretty(),
+		Addrs:       member.Addrs,
+		State:       member.State,
+		Incarnation: member.Incarnation,
+	}
+}
+
+// selfUpdate returns an update about <node> itself. It must be called with
+// the lock held.
+func (membership *Membership) selfUpdate(state MemberState) MemberUpdate {
+	var addrs []string
+	for _, address := range membership.node.Addrs() {
+		addrs = append(addrs, address.String())
+	}
+	return MemberUpdate{
+		ID:          membership.node.ID().Pretty(),
+		Addrs:       addrs,
+		State:       state,
+		Incarnation: membership.incarnation,
+	}
+}
+
+// announcement returns an update that says <node> is alive
+func (membership *Membership) announcement() MemberUpdate {
+	membership.mutex.RLock()
+	defer membership.mutex.RUnlock()
+	return membership.selfUpdate(MemberAlive)
+}
+
+// addAddrs adds <addrs> of <peerID> to the address book so that it can be
+// dialed
+func (membership *Membership) addAddrs(peerID peer.ID, addrs []string) {
+	membership.mutex.Lock()
+	defer membership.mutex.Unlock()
+	membership.addAddrsLocked(peerID, addrs)
+}
+
+// addAddrsLocked is <addAddrs> for callers that hold the lock already
+func (membership *Membership) addAddrsLocked(peerID peer.ID, addrs []string) {
+	for _, address := range addrs {
+		decoded, err := multiaddr.NewMultiaddr(address)
+		if err != nil {
+			continue
+		}
+		membership.node.Peerstore().AddAddr(peerID, decoded, memberAddrTTL)
+	}
+}
+
+// Members returns every known member of the cluster <node> is part of
+func (node *PeerNode) Members() []Member {
+	return node.membership.Members()
+}
+
+// Membership returns the SWIM cluster membership of <node>, which is used
+// to join and leave clusters and to subscribe to join and leave events.
+func (node *PeerNode) Membership() *Membership {
+	return node.membership
+}
@@ -0,0 +1,1023 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Payment channel protocol is used to open, update and close payment
+// channels between two nodes
+const channelProtocol = "/payment-channel/1.0.0"
+
+// Both sides keep their channels in this bucket of the ledger database,
+// keyed by the ID of the channel
+var channelsBucket = []byte("channels")
+
+// The types of a <ChannelMessage>
+const (
+	channelOpen       = "open"
+	channelUpdate     = "update"
+	channelClose      = "close"
+	channelForceClose = "force-close"
+	channelAccept     = "accept"
+	channelRefuse     = "refuse"
+)
+
+// The status of a <ChannelRecord>
+const (
+	// ChannelOpening is the status of a channel the opener asked the
+	// other side to accept
+	ChannelOpening = "opening"
+	// ChannelOpen is the status of a channel both sides signed
+	ChannelOpen = "open"
+	// ChannelClosed is the status of a channel that was settled in the
+	// ledger
+	ChannelClosed = "closed"
+)
+
+// ChannelState is one state of a payment channel: how much of the deposits
+// belongs to the <Opener> and how much to the <Acceptor>. Every state has
+// a higher <Sequence> than the one before and only counts once both sides
+// signed it. A <Final> state is the one a channel was closed with.
+// ----------------------------------------------------------------------------
+// Payments in the channel only change the state, nothing is booked in the
+// ledger until the channel is closed. The balances always add up to the
+// deposits both sides locked when the channel was opened.
+type ChannelState struct {
+	Channel           string
+	Opener            string
+	Acceptor          string
+	Asset             string
+	Sequence          uint64 `json:",string"`
+	OpenerBalance     int64  `json:",string"`
+	AcceptorBalance   int64  `json:",string"`
+	Final             bool
+	OpenerSignature   []byte
+	OpenerPublicKey   []byte
+	AcceptorSignature []byte
+	AcceptorPublicKey []byte
+}
+
+// ChannelMessage is what the two sides of a channel send each other on the
+// payment channel stream. A reply is either <"accept"> with the state
+// signed by both sides or <"refuse"> with the reason and, if there is one,
+// the latest state the refusing side knows.
+type ChannelMessage struct {
+	Type  string
+	State *ChannelState `json:",omitempty"`
+	Error string        `json:",omitempty"`
+}
+
+// ChannelRecord is a channel as one side keeps it: the latest state signed
+// by both sides, the deposits and, once it is closed, with which state it
+// was settled. <Opener> tells if this side opened the channel.
+type ChannelRecord struct {
+	State           ChannelState
+	Peer            string
+	Opener          bool
+	OpenerDeposit   int64 `json:",string"`
+	AcceptorDeposit int64 `json:",string"`
+	Status          string
+	SettledSequence uint64 `json:",string"`
+	SettledBalance  int64  `json:",string"`
+}
+
+// signingBytes returns the canonical encoding of <state> that both sides
+// sign. It covers every field but the signatures.
+func (state *ChannelState) signingBytes() []byte {
+	var final uint64
+	if state.Final {
+		final = 1
+	}
+	return newCanonicalEncoder("libp2p-examples channel state").
+		String(state.Channel).
+		String(state.Opener).
+		String(state.Acceptor).
+		String(state.Asset).
+		Uint(state.Sequence).
+		Int(state.OpenerBalance).
+		Int(state.AcceptorBalance).
+		Uint(final).
+		Encoded()
+}
+
+// next returns a copy of <state> with the next sequence number and without
+// signatures
+func (state *ChannelState) next() *ChannelState {
+	next := *state
+	next.Sequence++
+	next.OpenerSignature, next.OpenerPublicKey = nil, nil
+	next.AcceptorSignature, next.AcceptorPublicKey = nil, nil
+	return &next
+}
+
+// sign adds the signature of <node> for its side of <state>
+func (state *ChannelState) sign(node *PeerNode) error {
+	signature, publicKey, err := node.sign(state.signingBytes())
+	if err != nil {
+		return err
+	}
+	switch peer.IDB58Encode(node.ID()) {
+	case state.Opener:
+		state.OpenerSignature, state.OpenerPublicKey = signature, publicKey
+	case state.Acceptor:
+		state.AcceptorSignature, state.AcceptorPublicKey = signature, publicKey
+	default:
+		return fmt.Errorf("%s is not a side of channel %s", node.ID().Pretty(), state.Channel)
+	}
+	return nil
+}
+
+// verifySide checks the signature of the opener, or of the acceptor when
+// <opener> is false
+func (state *ChannelState) verifySide(opener bool) error {
+	id, signature, publicKey := state.Acceptor, state.AcceptorSignature, state.AcceptorPublicKey
+	if opener {
+		id, signature, publicKey = state.Opener, state.OpenerSignature, state.OpenerPublicKey
+	}
+	peerID, err := peer.IDB58Decode(id)
+	if err != nil {
+		return fmt.Errorf("invalid peer %q: %s", id, err)
+	}
+	err = verifySignature(peerID, state.signingBytes(), signature, publicKey)
+	if err != nil {
+		return fmt.Errorf("channel state %d: %s", state.Sequence, err)
+	}
+	return nil
+}
+
+// verify checks that both sides signed <state>
+func (state *ChannelState) verify() error {
+	err := state.verifySide(true)
+	if err != nil {
+		return err
+	}
+	return state.verifySide(false)
+}
+
+// sameAs tells if <state> and <other> are the same state, no matter who
+// signed them
+func (state *ChannelState) sameAs(other *ChannelState) bool {
+	return other != nil && string(state.signingBytes()) == string(other.signingBytes())
+}
+
+// balance returns the balance of the opener in <state>, or of the acceptor
+// when <opener> is false
+func (state *ChannelState) balance(opener bool) int64 {
+	if opener {
+		return state.OpenerBalance
+	}
+	return state.AcceptorBalance
+}
+
+// ownDeposit returns the deposit this side locked
+func (record *ChannelRecord) ownDeposit() int64 {
+	if record.Opener {
+		return record.OpenerDeposit
+	}
+	return record.AcceptorDeposit
+}
+
+// otherDeposit returns the deposit the other side locked
+func (record *ChannelRecord) otherDeposit() int64 {
+	if record.Opener {
+		return record.AcceptorDeposit
+	}
+	return record.OpenerDeposit
+}
+
+// consistent checks that <state> belongs to the channel of <record> and
+// that its balances add up to the deposits
+func (record *ChannelRecord) consistent(state *ChannelState) error {
+	if state == nil {
+		return fmt.Errorf("missing channel state")
+	}
+	current := record.State
+	if state.Channel != current.Channel || state.Opener != current.Opener ||
+		state.Acceptor != current.Acceptor || state.Asset != current.Asset {
+		return fmt.Errorf("the state is not for channel %s", current.Channel)
+	}
+	if state.OpenerBalance < 0 || state.AcceptorBalance < 0 ||
+		state.OpenerBalance+state.AcceptorBalance != record.OpenerDeposit+record.AcceptorDeposit {
+		return fmt.Errorf("the balances of the state do not add up to the deposits")
+	}
+	return nil
+}
+
+// adopt stores the latest state <reply> carries, if both sides signed it
+// and it is newer than what we have. A side that lost a reply gets back in
+// step this way. A final state means the other side closed the channel
+// with a state we signed, so the channel is settled with it.
+func (node *PeerNode) adopt(record *ChannelRecord, reply *ChannelMessage) {
+	state := reply.State
+	if state == nil || state.Sequence <= record.State.Sequence ||
+		record.consistent(state) != nil || state.verify() != nil {
+		return
+	}
+	if state.Final {
+		_, err := node.ledger.SettleChannel(state)
+		if err == nil {
+			fmt.Printf("Channel %s: closed with state %d\n", state.Channel, state.Sequence)
+		}
+		return
+	}
+	_, err := node.ledger.AdvanceChannel(state)
+	if err == nil {
+		fmt.Printf("Channel %s: caught up to state %d\n", state.Channel, state.Sequence)
+	}
+}
+
+// parseChannelDepositLimits reads the <ChannelDepositLimits> of the config
+// into minor units of every asset.
+// ----------------------------------------------------------------------------
+// It returns an error in case a limit is not a valid amount of an asset of
+// <assets>.
+func parseChannelDepositLimits(assets AssetRegistry, limits map[string]string) (map[string]int64, error) {
+	result := make(map[string]int64)
+	for asset, text := range limits {
+		asset = strings.ToUpper(asset)
+		decimals, err := assets.Decimals(asset)
+		if err != nil {
+			return nil, fmt.Errorf("channel deposit limit: %s", err)
+		}
+		limit, err := parseUnits(text, decimals)
+		if err != nil {
+			return nil, fmt.Errorf("channel deposit limit of %s: %s", asset, err)
+		}
+		result[asset] = limit
+	}
+	return result, nil
+}
+
+// claimChannel makes sure only one update of the channel with <id> runs at
+// a time on <node>. Updates that come in while another one runs are
+// refused instead of waiting, so two nodes paying each other at the same
+// time cannot block each other.
+// ----------------------------------------------------------------------------
+// it returns the function that releases the channel
+// It returns an error in case the channel is busy.
+func (node *PeerNode) claimChannel(id string) (func(), error) {
+	node.channelMutex.Lock()
+	defer node.channelMutex.Unlock()
+	if node.channelsBusy == nil {
+		node.channelsBusy = make(map[string]bool)
+	}
+	if node.channelsBusy[id] {
+		return nil, fmt.Errorf("channel %s is busy, try again", id)
+	}
+	node.channelsBusy[id] = true
+	return func() {
+		node.channelMutex.Lock()
+		delete(node.channelsBusy, id)
+		node.channelMutex.Unlock()
+	}, nil
+}
+
+// sendChannelMessage writes <message> to <wrappedTransactionStream>
+func (wrappedTransactionStream *TransactionStream) sendChannelMessage(message *ChannelMessage) error {
+	err := wrappedTransactionStream.encoder.Encode(message)
+	if err != nil {
+		return err
+	}
+	return wrappedTransactionStream.writer.Flush()
+}
+
+// readChannelMessage reads a <ChannelMessage> from <wrappedTransactionStream>
+func (wrappedTransactionStream *TransactionStream) readChannelMessage() (*ChannelMessage, error) {
+	var message ChannelMessage
+	err := wrappedTransactionStream.decoder.Decode(&message)
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// exchangeChannelMessage sends <message> to <peerID> on a new payment
+// channel stream and reads the reply.
+// ----------------------------------------------------------------------------
+// It returns an error in case the stream broke or the reply is a refusal.
+// The reply is returned with a refusal as well, since it can carry the
+// latest state of the other side.
+func (node *PeerNode) exchangeChannelMessage(peerID peer.ID, message *ChannelMessage) (*ChannelMessage, error) {
+	stream, err := node.NewStream(streamContext(channelProtocol), peerID, channelProtocol)
+	if err != nil {
+		return nil, err
+	}
+	stream.SetDeadline(time.Now().Add(paymentTimeout))
+	wrappedTransactionStream := WrapTransactionStream(stream)
+	err = wrappedTransactionStream.sendChannelMessage(message)
+	if err != nil {
+		stream.Reset()
+		return nil, err
+	}
+	stream.CloseWrite()
+	reply, err := wrappedTransactionStream.readChannelMessage()
+	if err != nil {
+		stream.Reset()
+		return nil, err
+	}
+	stream.Close()
+	if reply.Type != channelAccept {
+		return reply, fmt.Errorf("refused by %s: %s", peerID.Pretty(), reply.Error)
+	}
+	return reply, nil
+}
+
+// OpenChannel opens a payment channel with the node at <destination>.
+// ----------------------------------------------------------------------------
+// <deposit> is what <node> locks in its ledger and can pay through the
+// channel, <peerDeposit> is what the other node is asked to lock. Either
+// can be 0, but not both, and they have to be in the same asset.
+// ----------------------------------------------------------------------------
+// it returns the record of the open channel
+// It returns an error in case the node keeps no ledger, the deposit would
+// go past the credit limit or the other node refused the channel.
+func (node *PeerNode) OpenChannel(destination string, deposit Money, peerDeposit Money) (*ChannelRecord, error) {
+	if node.ledger == nil {
+		return nil, fmt.Errorf("this node keeps no ledger, so it cannot lock a deposit")
+	}
+	if deposit.Asset != peerDeposit.Asset {
+		return nil, fmt.Errorf("both deposits have to be in the same asset")
+	}
+	_, err := node.assets.Decimals(deposit.Asset)
+	if err != nil {
+		return nil, err
+	}
+	total, err := addUnits(deposit.Units, peerDeposit.Units)
+	if err != nil {
+		return nil, err
+	}
+	if deposit.Units < 0 || peerDeposit.Units < 0 || total <= 0 {
+		return nil, fmt.Errorf("the deposits cannot be negative and one of them has to be positive")
+	}
+	peerID, err := addAddressToPeerstore(node, destination)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+	state := &ChannelState{
+		Channel:         id,
+		Opener:          peer.IDB58Encode(node.ID()),
+		Acceptor:        peer.IDB58Encode(peerID),
+		Asset:           deposit.Asset,
+		OpenerBalance:   deposit.Units,
+		AcceptorBalance: peerDeposit.Units,
+	}
+	err = state.sign(node)
+	if err != nil {
+		return nil, err
+	}
+	// our deposit is locked before we ask, so that it cannot be spent
+	// while the other node decides
+	err = node.ledger.AddChannel(&ChannelRecord{
+		State:           *state,
+		Peer:            peer.IDB58Encode(peerID),
+		Opener:          true,
+		OpenerDeposit:   deposit.Units,
+		AcceptorDeposit: peerDeposit.Units,
+		Status:          ChannelOpening,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return node.confirmChannelOpen(peerID, state)
+}
+
+// confirmChannelOpen sends the open of the channel with the first <state>
+// to <peerID> and opens the channel with the state both sides signed.
+// The open is sent up to <maxPaymentAttempts> times until the other side
+// answers. The other side answers a repeated open with the state it signed
+// the first time, so a retry cannot lock its deposit twice.
+// ----------------------------------------------------------------------------
+// it returns the record of the open channel
+// It returns an error in case the other side refused the channel, which
+// removes the channel and unlocks our deposit, or could not be reached.
+// Without an answer we cannot know if the other side locked its deposit,
+// so the channel stays opening until <CloseChannel> with force settles it.
+func (node *PeerNode) confirmChannelOpen(peerID peer.ID, state *ChannelState) (*ChannelRecord, error) {
+	var reply *ChannelMessage
+	var err error
+	for attempt := 1; ; attempt++ {
+		reply, err = node.exchangeChannelMessage(peerID, &ChannelMessage{Type: channelOpen, State: state})
+		if reply != nil || attempt == maxPaymentAttempts {
+			break
+		}
+		fmt.Printf("Channel %s: attempt %d to open failed: %s\n", state.Channel, attempt, err)
+		time.Sleep(time.Duration(attempt) * paymentRetryDelay)
+	}
+	if reply == nil {
+		return nil, fmt.Errorf("%s; channel %s stays opening, use close --force to try again or give it up", err, state.Channel)
+	}
+	if err == nil && !state.sameAs(reply.State) {
+		err = fmt.Errorf("the reply is for another state")
+	}
+	if err == nil {
+		err = reply.State.verify()
+	}
+	if err != nil {
+		// the other side answered without opening the channel, so our
+		// deposit is unlocked again
+		node.ledger.RemoveChannel(state.Channel)
+		return nil, fmt.Errorf("%s; channel %s was removed and our deposit unlocked", err, state.Channel)
+	}
+	return node.ledger.AdvanceChannel(reply.State)
+}
+
+// ChannelPay pays <amount> to the other side of the channel with <id>. Both
+// sides sign the new state, nothing is booked in the ledger.
+// ----------------------------------------------------------------------------
+// it returns the new state of the channel
+// It returns an error in case the channel is not open, the amount is more
+// than our balance in the channel or the other side refused the state.
+func (node *PeerNode) ChannelPay(id string, amount Money) (*ChannelState, error) {
+	if node.ledger == nil {
+		return nil, fmt.Errorf("this node keeps no ledger")
+	}
+	release, err := node.claimChannel(id)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	record, err := node.ledger.Channel(id)
+	if err != nil {
+		return nil, err
+	}
+	if record.Status != ChannelOpen {
+		return nil, fmt.Errorf("channel %s is %s", id, record.Status)
+	}
+	if amount.Asset != record.State.Asset || amount.Units <= 0 {
+		return nil, fmt.Errorf("the channel can only pay a positive amount of %s", record.State.Asset)
+	}
+	state := record.State.next()
+	if record.Opener {
+		state.OpenerBalance -= amount.Units
+		state.AcceptorBalance += amount.Units
+	} else {
+		state.AcceptorBalance -= amount.Units
+		state.OpenerBalance += amount.Units
+	}
+	if state.balance(record.Opener) < 0 {
+		return nil, fmt.Errorf("only %s is left in channel %s", node.assets.Format(Money{Units: record.State.balance(record.Opener), Asset: amount.Asset}), id)
+	}
+	err = state.sign(node)
+	if err != nil {
+		return nil, err
+	}
+	peerID, err := peer.IDB58Decode(record.Peer)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := node.exchangeChannelMessage(peerID, &ChannelMessage{Type: channelUpdate, State: state})
+	if err != nil {
+		if reply != nil {
+			node.adopt(record, reply)
+		}
+		return nil, err
+	}
+	if !state.sameAs(reply.State) {
+		return nil, fmt.Errorf("the reply is for another state")
+	}
+	err = reply.State.verify()
+	if err != nil {
+		return nil, err
+	}
+	_, err = node.ledger.AdvanceChannel(reply.State)
+	if err != nil {
+		return nil, err
+	}
+	return reply.State, nil
+}
+
+// CloseChannel closes the channel with <id> and settles it in the ledger.
+// ----------------------------------------------------------------------------
+// Without <force> both sides sign a final state with the balances of the
+// latest state, and the channel is settled with it. With <force> we settle
+// with the latest state both sides signed without asking. The other side is
+// still told: it settles with the newer one of its own latest state and
+// ours, and sends it back, so publishing an old state gains nothing.
+// ----------------------------------------------------------------------------
+// it returns the record of the closed channel
+// It returns an error in case the channel is not open, or the other side
+// cannot be reached or refused a cooperative close.
+func (node *PeerNode) CloseChannel(id string, force bool) (*ChannelRecord, error) {
+	if node.ledger == nil {
+		return nil, fmt.Errorf("this node keeps no ledger")
+	}
+	release, err := node.claimChannel(id)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	record, err := node.ledger.Channel(id)
+	if err != nil {
+		return nil, err
+	}
+	if record.Status == ChannelOpening && !force {
+		return nil, fmt.Errorf("channel %s is still opening, use --force to try again or give it up", id)
+	}
+	if record.Status == ChannelClosed && !force {
+		return nil, fmt.Errorf("channel %s is closed already", id)
+	}
+	peerID, err := peer.IDB58Decode(record.Peer)
+	if err != nil {
+		return nil, err
+	}
+	// the reply to our open got lost. The open is sent again: if the other
+	// side has the channel, it sends back the state it signed and the
+	// channel is closed like any open one, otherwise it is removed.
+	if record.Status == ChannelOpening {
+		if !record.Opener {
+			return nil, fmt.Errorf("channel %s is still opening", id)
+		}
+		record, err = node.confirmChannelOpen(peerID, &record.State)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if force {
+		latest := record.State
+		reply, err := node.exchangeChannelMessage(peerID, &ChannelMessage{Type: channelForceClose, State: &latest})
+		if err != nil {
+			fmt.Printf("Channel %s: %s, settling with state %d\n", id, err, latest.Sequence)
+		} else if reply.State != nil && reply.State.Sequence > latest.Sequence &&
+			record.consistent(reply.State) == nil && reply.State.verify() == nil {
+			// our state was older than the one of the other side, which we
+			// signed as well
+			latest = *reply.State
+		}
+		return node.ledger.SettleChannel(&latest)
+	}
+	state := record.State.next()
+	state.Final = true
+	err = state.sign(node)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := node.exchangeChannelMessage(peerID, &ChannelMessage{Type: channelClose, State: state})
+	if err != nil {
+		if reply != nil {
+			node.adopt(record, reply)
+		}
+		return nil, fmt.Errorf("%s; use --force to close it on our own", err)
+	}
+	if !state.sameAs(reply.State) {
+		return nil, fmt.Errorf("the reply is for another state")
+	}
+	err = reply.State.verify()
+	if err != nil {
+		return nil, err
+	}
+	return node.ledger.SettleChannel(reply.State)
+}
+
+// handleChannel answers a message of the other side of a channel. It is
+// mounted by <PaymentProtocolMultiplexer>.
+func (node *PeerNode) handleChannel(stream net.Stream) {
+	remote := stream.Conn().RemotePeer()
+	// refuse the stream if the remote peer is not allowed to use
+	// this protocol
+	if !node.streamAllowed(channelProtocol, remote) {
+		stream.Reset()
+		return
+	}
+	stream.SetDeadline(time.Now().Add(paymentTimeout))
+	wrappedTransactionStream := WrapTransactionStream(stream)
+	message, err := wrappedTransactionStream.readChannelMessage()
+	if err != nil {
+		stream.Reset()
+		return
+	}
+	var reply *ChannelMessage
+	switch {
+	case node.ledger == nil:
+		reply = &ChannelMessage{Type: channelRefuse, Error: "this node keeps no ledger"}
+	case message.State == nil:
+		reply = &ChannelMessage{Type: channelRefuse, Error: "missing channel state"}
+	case message.Type == channelOpen:
+		reply = node.acceptChannelOpen(remote, message.State)
+	case message.Type == channelUpdate || message.Type == channelClose:
+		reply = node.acceptChannelUpdate(remote, message.Type, message.State)
+	case message.Type == channelForceClose:
+		reply = node.acceptChannelForceClose(remote, message.State)
+	default:
+		reply = &ChannelMessage{Type: channelRefuse, Error: fmt.Sprintf("unknown message %q", message.Type)}
+	}
+	if reply.Type == channelRefuse {
+		fmt.Printf("Channel %s refused: %s\n", message.Type, reply.Error)
+	}
+	err = wrappedTransactionStream.sendChannelMessage(reply)
+	if err != nil {
+		stream.Reset()
+		return
+	}
+	stream.Close()
+}
+
+// acceptChannelOpen locks our deposit for the channel <remote> asks for
+// with <state> and signs it
+func (node *PeerNode) acceptChannelOpen(remote peer.ID, state *ChannelState) *ChannelMessage {
+	refuse := func(err error) *ChannelMessage {
+		return &ChannelMessage{Type: channelRefuse, Error: err.Error()}
+	}
+	if state.Opener != peer.IDB58Encode(remote) || state.Acceptor != peer.IDB58Encode(node.ID()) {
+		return refuse(fmt.Errorf("the channel is not between %s and us", remote.Pretty()))
+	}
+	err := validateTransactionID(state.Channel)
+	if err != nil {
+		return refuse(err)
+	}
+	_, err = node.assets.Decimals(state.Asset)
+	if err != nil {
+		return refuse(err)
+	}
+	total, err := addUnits(state.OpenerBalance, state.AcceptorBalance)
+	if err != nil || state.Sequence != 0 || state.Final || state.OpenerBalance < 0 || state.AcceptorBalance < 0 || total <= 0 {
+		return refuse(fmt.Errorf("invalid first state of a channel"))
+	}
+	// the opener picks the deposit we lock, so it has to be within what we
+	// agreed to lock for anyone in <ChannelDepositLimits>
+	if limit := node.channelDepositLimits[state.Asset]; state.AcceptorBalance > limit {
+		return refuse(fmt.Errorf("we lock at most %s in a channel we did not open", node.assets.Format(Money{Units: limit, Asset: state.Asset})))
+	}
+	err = state.verifySide(true)
+	if err != nil {
+		return refuse(err)
+	}
+	// an open we accepted before is answered with the state we signed then,
+	// since the opener did not get our reply
+	node.channelOpenMutex.Lock()
+	defer node.channelOpenMutex.Unlock()
+	if record, err := node.ledger.Channel(state.Channel); err == nil {
+		if record.Peer != peer.IDB58Encode(remote) || record.Opener || record.State.Sequence != 0 || !record.State.sameAs(state) {
+			return refuse(fmt.Errorf("channel %s exists already", state.Channel))
+		}
+		return &ChannelMessage{Type: channelAccept, State: &record.State}
+	}
+	err = state.sign(node)
+	if err != nil {
+		return refuse(err)
+	}
+	// <AddChannel> checks both deposits against the credit limit with
+	// <remote>, so settling the channel cannot go past it
+	err = node.ledger.AddChannel(&ChannelRecord{
+		State:           *state,
+		Peer:            peer.IDB58Encode(remote),
+		OpenerDeposit:   state.OpenerBalance,
+		AcceptorDeposit: state.AcceptorBalance,
+		Status:          ChannelOpen,
+	})
+	if err != nil {
+		return refuse(err)
+	}
+	fmt.Printf("Channel %s opened by %s\n", state.Channel, remote.Pretty())
+	return &ChannelMessage{Type: channelAccept, State: state}
+}
+
+// acceptChannelUpdate signs the next <state> of a channel with <remote>.
+// An update has to pay us, a close has to keep the balances and be final.
+// A refusal carries our latest state, so that the other side can catch up.
+func (node *PeerNode) acceptChannelUpdate(remote peer.ID, kind string, state *ChannelState) *ChannelMessage {
+	release, err := node.claimChannel(state.Channel)
+	if err != nil {
+		return &ChannelMessage{Type: channelRefuse, Error: err.Error()}
+	}
+	defer release()
+	record, err := node.ledger.Channel(state.Channel)
+	if err != nil || record.Peer != peer.IDB58Encode(remote) {
+		return &ChannelMessage{Type: channelRefuse, Error: fmt.Sprintf("unknown channel %s", state.Channel)}
+	}
+	latest := record.State
+	refuse := func(err error) *ChannelMessage {
+		return &ChannelMessage{Type: channelRefuse, Error: err.Error(), State: &latest}
+	}
+	if record.Status != ChannelOpen {
+		return refuse(fmt.Errorf("channel %s is %s", state.Channel, record.Status))
+	}
+	err = record.consistent(state)
+	if err != nil {
+		return refuse(err)
+	}
+	if state.Sequence != latest.Sequence+1 {
+		return refuse(fmt.Errorf("state %d does not follow state %d", state.Sequence, latest.Sequence))
+	}
+	ours := state.balance(record.Opener) - latest.balance(record.Opener)
+	switch {
+	case kind == channelUpdate && (state.Final || ours <= 0):
+		return refuse(fmt.Errorf("an update has to pay the other side"))
+	case kind == channelClose && (!state.Final || ours != 0):
+		return refuse(fmt.Errorf("a close has to keep the balances of the latest state"))
+	}
+	err = state.verifySide(!record.Opener)
+	if err != nil {
+		return refuse(err)
+	}
+	err = state.sign(node)
+	if err != nil {
+		return refuse(err)
+	}
+	if kind == channelClose {
+		_, err = node.ledger.SettleChannel(state)
+	} else {
+		_, err = node.ledger.AdvanceChannel(state)
+	}
+	if err != nil {
+		return refuse(err)
+	}
+	if kind == channelClose {
+		fmt.Printf("Channel %s closed by %s\n", state.Channel, remote.Pretty())
+	} else {
+		fmt.Printf("Channel %s: received %s (state %d)\n", state.Channel,
+			node.assets.Format(Money{Units: ours, Asset: state.Asset}), state.Sequence)
+	}
+	return &ChannelMessage{Type: channelAccept, State: state}
+}
+
+// acceptChannelForceClose settles the channel <remote> closed on its own
+// with <state>. If we know a newer state, <state> is stale: the channel is
+// settled with ours and it is sent back.
+func (node *PeerNode) acceptChannelForceClose(remote peer.ID, state *ChannelState) *ChannelMessage {
+	release, err := node.claimChannel(state.Channel)
+	if err != nil {
+		return &ChannelMessage{Type: channelRefuse, Error: err.Error()}
+	}
+	defer release()
+	record, err := node.ledger.Channel(state.Channel)
+	if err != nil || record.Peer != peer.IDB58Encode(remote) {
+		return &ChannelMessage{Type: channelRefuse, Error: fmt.Sprintf("unknown channel %s", state.Channel)}
+	}
+	err = record.consistent(state)
+	if err == nil {
+		err = state.verify()
+	}
+	if err != nil {
+		return &ChannelMessage{Type: channelRefuse, Error: err.Error(), State: &record.State}
+	}
+	settled, err := node.ledger.SettleChannel(state)
+	if err != nil {
+		return &ChannelMessage{Type: channelRefuse, Error: err.Error(), State: &record.State}
+	}
+	if settled.State.Sequence > state.Sequence {
+		fmt.Printf("Channel %s: %s closed it with the stale state %d, settled with state %d\n",
+			state.Channel, remote.Pretty(), state.Sequence, settled.State.Sequence)
+	} else {
+		fmt.Printf("Channel %s closed by %s on its own\n", state.Channel, remote.Pretty())
+	}
+	return &ChannelMessage{Type: channelAccept, State: &settled.State}
+}
+
+// AddChannel keeps <record> and locks the deposit of this side, which has
+// to fit in the credit limit with the other side like a payment. The
+// deposit of the other side can all end up with us, so it has to fit in the
+// credit limit like a payment we receive.
+func (ledger *Ledger) AddChannel(record *ChannelRecord) error {
+	peerID, err := peer.IDB58Decode(record.Peer)
+	if err != nil {
+		return err
+	}
+	return ledger.db.Update(func(tx *bolt.Tx) error {
+		channels := tx.Bucket(channelsBucket)
+		if channels.Get([]byte(record.State.Channel)) != nil {
+			return fmt.Errorf("channel %s exists already", record.State.Channel)
+		}
+		_, err := ledger.nextBalanceLocked(tx, peerID, record.State.Asset, -record.ownDeposit())
+		if err != nil {
+			return err
+		}
+		_, err = ledger.nextBalanceLocked(tx, peerID, record.State.Asset, record.otherDeposit())
+		if err != nil {
+			return err
+		}
+		return ledger.putChannelLocked(tx, record)
+	})
+}
+
+// RemoveChannel forgets the channel with <id> and unlocks its deposit. It
+// is only used for channels the other side refused to open.
+func (ledger *Ledger) RemoveChannel(id string) error {
+	return ledger.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(channelsBucket).Delete([]byte(id))
+	})
+}
+
+// Channel returns the channel with <id>
+func (ledger *Ledger) Channel(id string) (*ChannelRecord, error) {
+	var record *ChannelRecord
+	err := ledger.db.View(func(tx *bolt.Tx) error {
+		var err error
+		record, err = ledger.channelLocked(tx, id)
+		return err
+	})
+	return record, err
+}
+
+// Channels returns every channel of the ledger, sorted by ID
+func (ledger *Ledger) Channels() ([]ChannelRecord, error) {
+	var records []ChannelRecord
+	err := ledger.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(channelsBucket).ForEach(func(key, value []byte) error {
+			var record ChannelRecord
+			err := json.Unmarshal(value, &record)
+			if err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].State.Channel < records[j].State.Channel
+	})
+	return records, err
+}
+
+// AdvanceChannel stores <state>, which both sides signed, as the latest
+// state of its channel. An opening channel is open from then on.
+// ----------------------------------------------------------------------------
+// It returns an error in case the channel is closed or <state> is not newer
+// than the latest state. The first state is the exception while the
+// channel is opening.
+func (ledger *Ledger) AdvanceChannel(state *ChannelState) (*ChannelRecord, error) {
+	var record *ChannelRecord
+	err := ledger.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		record, err = ledger.channelLocked(tx, state.Channel)
+		if err != nil {
+			return err
+		}
+		switch {
+		case record.Status == ChannelOpening && state.Sequence == 0:
+			record.Status = ChannelOpen
+		case record.Status != ChannelOpen:
+			return fmt.Errorf("channel %s is %s", state.Channel, record.Status)
+		case state.Sequence <= record.State.Sequence:
+			return fmt.Errorf("channel %s is at state %d already", state.Channel, record.State.Sequence)
+		}
+		record.State = *state
+		return ledger.putChannelLocked(tx, record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// SettleChannel closes the channel of <state> and books what this side won
+// or lost in it since the deposits were locked. The channel is settled with
+// the newer one of <state> and the latest state we know, so a stale state
+// of the other side is never settled.
+// ----------------------------------------------------------------------------
+// A closed channel can be settled again with a newer state, for example
+// when we closed it on our own without the latest state and the other side
+// sends it later. Only the difference is booked then.
+// The settlement is booked even past the credit limit, since both sides
+// agreed to the deposits and their balances.
+func (ledger *Ledger) SettleChannel(state *ChannelState) (*ChannelRecord, error) {
+	var record *ChannelRecord
+	err := ledger.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		record, err = ledger.channelLocked(tx, state.Channel)
+		if err != nil {
+			return err
+		}
+		if record.Status == ChannelOpening {
+			return fmt.Errorf("channel %s is still opening", state.Channel)
+		}
+		if state.Sequence > record.State.Sequence {
+			record.State = *state
+		}
+		balance := record.State.balance(record.Opener)
+		var amount int64
+		switch {
+		case record.Status != ChannelClosed:
+			amount = balance - record.ownDeposit()
+		case record.State.Sequence > record.SettledSequence:
+			amount = balance - record.SettledBalance
+		default:
+			return nil
+		}
+		record.Status = ChannelClosed
+		record.SettledSequence = record.State.Sequence
+		record.SettledBalance = balance
+		if amount != 0 {
+			err = ledger.settleLocked(tx, record.Peer, record.State.Asset, amount)
+			if err != nil {
+				return err
+			}
+		}
+		return ledger.putChannelLocked(tx, record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// settleLocked books <amount> with the peer <id> in <asset> without
+// checking the credit limit
+func (ledger *Ledger) settleLocked(tx *bolt.Tx, id string, asset string, amount int64) error {
+	accounts := tx.Bucket(accountsBucket)
+	balance, err := addUnits(decodeUnits(accounts.Get(accountKey(id, asset))), amount)
+	if err != nil {
+		return err
+	}
+	err = accounts.Put(accountKey(id, asset), encodeUnits(balance))
+	if err != nil {
+		return err
+	}
+	return ledger.appendEntryLocked(tx, LedgerEntry{
+		Time:    time.Now(),
+		Peer:    id,
+		Asset:   asset,
+		Amount:  amount,
+		Balance: balance,
+	})
+}
+
+// lockedLocked returns how much of <asset> this side locked in channels
+// with the peer <id> that are not closed yet
+func (ledger *Ledger) lockedLocked(tx *bolt.Tx, id string, asset string) int64 {
+	return ledger.depositsLocked(tx, id, asset, (*ChannelRecord).ownDeposit)
+}
+
+// incomingLocked returns how much of <asset> the peer <id> locked in
+// channels with us that are not closed yet
+func (ledger *Ledger) incomingLocked(tx *bolt.Tx, id string, asset string) int64 {
+	return ledger.depositsLocked(tx, id, asset, (*ChannelRecord).otherDeposit)
+}
+
+// depositsLocked adds up <deposit> of every channel in <asset> with the
+// peer <id> that is not closed yet
+func (ledger *Ledger) depositsLocked(tx *bolt.Tx, id string, asset string, deposit func(*ChannelRecord) int64) int64 {
+	var locked int64
+	tx.Bucket(channelsBucket).ForEach(func(key, value []byte) error {
+		var record ChannelRecord
+		if json.Unmarshal(value, &record) == nil && record.Peer == id &&
+			record.State.Asset == asset && record.Status != ChannelClosed {
+			locked += deposit(&record)
+		}
+		return nil
+	})
+	return locked
+}
+
+// channelLocked reads the channel with <id>
+func (ledger *Ledger) channelLocked(tx *bolt.Tx, id string) (*ChannelRecord, error) {
+	data := tx.Bucket(channelsBucket).Get([]byte(id))
+	if data == nil {
+		return nil, fmt.Errorf("unknown channel %s", id)
+	}
+	record := &ChannelRecord{}
+	return record, json.Unmarshal(data, record)
+}
+
+// putChannelLocked writes <record>
+func (ledger *Ledger) putChannelLocked(tx *bolt.Tx, record *ChannelRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(channelsBucket).Put([]byte(record.State.Channel), data)
+}
+
+// FormatChannel writes <record> as one line, with the balances of this side
+// and the other side
+func (ledger *Ledger) FormatChannel(record ChannelRecord) string {
+	ours := Money{Units: record.State.balance(record.Opener), Asset: record.State.Asset}
+	theirs := Money{Units: record.State.balance(!record.Opener), Asset: record.State.Asset}
+	return fmt.Sprintf("%s %s %s state %d: ours %s, theirs %s", record.State.Channel, record.Peer,
+		record.Status, record.State.Sequence, ledger.assets.Format(ours), ledger.assets.Format(theirs))
+}
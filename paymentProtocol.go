@@ -26,31 +26,193 @@ package main
 
 import (
 	"bufio"
-	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
 	json "github.com/multiformats/go-multicodec/json"
 
 	multicodec "github.com/multiformats/go-multicodec"
 )
 
 // Payment protocol is used to send a transaction
-// to another node
-const paymentProtocol = "/payment/1.0.0"
+// to another node. Version 2.0.0 sends amounts as minor units of an asset,
+// which nodes of version 1.0.0 cannot read.
+const paymentProtocol = "/payment/2.0.0"
 
-// Ping protocol is used reply back a message
-// to the node that sent out the transaction
-const pingProtocol = "/ping/1.0.0"
+// maxPaymentAttempts is how often a transaction is sent before the sender
+// gives up
+const maxPaymentAttempts = 3
+
+// paymentRetryDelay is how long the sender waits before the first retry,
+// every further retry waits one more <paymentRetryDelay>
+const paymentRetryDelay = 500 * time.Millisecond
+
+// paymentTimeout is how long one attempt to send a transaction can take
+const paymentTimeout = 30 * time.Second
+
+// ReceiptCode tells why the receiver node accepted or refused a transaction
+type ReceiptCode string
+
+// The codes of a <TransactionReceipt>
+const (
+	// ReceiptAccepted is the code of a transaction that was booked
+	ReceiptAccepted ReceiptCode = "accepted"
+	// ReceiptMalformed is the code of a transaction that could not be
+	// decoded or has no valid ID
+	ReceiptMalformed ReceiptCode = "malformed"
+	// ReceiptBadSignature is the code of a transaction that is not signed
+	// by the peer the stream comes from
+	ReceiptBadSignature ReceiptCode = "bad-signature"
+	// ReceiptInvalidAmount is the code of a transaction with an amount that
+	// is not positive or in an asset the receiver does not accept
+	ReceiptInvalidAmount ReceiptCode = "invalid-amount"
+	// ReceiptCreditLimit is the code of a transaction that would take the
+	// balance past the credit limit
+	ReceiptCreditLimit ReceiptCode = "credit-limit"
+	// ReceiptReplay is the code of a transaction with a nonce that is not
+	// higher than the last nonce of the sender
+	ReceiptReplay ReceiptCode = "replay"
+	// ReceiptInvoice is the code of a transaction that does not settle the
+	// invoice it names
+	ReceiptInvoice ReceiptCode = "invoice"
+	// ReceiptInternalError is the code of a transaction the receiver could
+	// not store. Nothing was booked, so it can be sent again.
+	ReceiptInternalError ReceiptCode = "internal-error"
+)
+
+// TransactionRefused is the error of a transaction the receiver node
+// refused, with the receipt it sent
+type TransactionRefused struct {
+	Receipt *TransactionReceipt
+}
+
+// Error returns the reason of <err> as text
+func (err *TransactionRefused) Error() string {
+	return fmt.Sprintf("refused by the receiver (%s): %s", err.Receipt.Code, err.Receipt.Reason)
+}
+
+// Temporary tells if sending the transaction again can change the verdict
+func (err *TransactionRefused) Temporary() bool {
+	return err.Receipt.Code == ReceiptInternalError
+}
 
 // TransactionWrapper is a struct that is used to hold information relevant
 // to a transaction such as <Sender> address, <Receiver> address and the <Amount>
-// that is getting transferred
+// that is getting transferred.
+// <ID> is a random identifier the sender picks and <Nonce> is higher than
+// the nonce of every earlier transaction of the sender, so the receiver can
+// tell a retry and a replay apart.
+// <Invoice> is the ID of the invoice of the receiver the transaction pays,
+// if any.
+// <Signature> is made by the sender over the canonical encoding of the
+// other fields and <PublicKey> is the key to check it with.
 type TransactionWrapper struct {
-	Sender   string
-	Receiver string
-	Amount   float64
+	ID        string
+	Nonce     uint64 `json:",string"`
+	Sender    string
+	Receiver  string
+	Amount    Money
+	Invoice   string `json:",omitempty"`
+	Signature []byte
+	PublicKey []byte
+}
+
+// TransactionReceipt is what the receiver node writes back on the payment
+// stream once it has processed and stored a transaction.
+// <ID> is the ID of the transaction, <Accepted> tells if it was booked and
+// <Code> and <Reason> say why. <Balance> is the balance of the receiver
+// with the sender after an accepted transaction, as the receiver sees it:
+// what the sender paid minus what the receiver paid.
+// An accepted receipt is signed by the receiver (<Payee>) over the hash of
+// the transaction, the <Amount>, the <Payer> and the <Time> it was booked,
+// so it can serve as a proof of payment.
+type TransactionReceipt struct {
+	ID          string
+	Accepted    bool
+	Code        ReceiptCode
+	Reason      string    `json:",omitempty"`
+	Balance     *Money    `json:",omitempty"`
+	Transaction string    `json:",omitempty"`
+	Amount      *Money    `json:",omitempty"`
+	Payer       string    `json:",omitempty"`
+	Payee       string    `json:",omitempty"`
+	Time        time.Time `json:",omitempty"`
+	Signature   []byte    `json:",omitempty"`
+	PublicKey   []byte    `json:",omitempty"`
+}
+
+// signingBytes returns the canonical encoding of <tx> that is signed. It
+// covers every field but the signature itself.
+func (tx *TransactionWrapper) signingBytes() []byte {
+	return newCanonicalEncoder("libp2p-examples transaction").
+		String(tx.ID).
+		Uint(tx.Nonce).
+		String(tx.Sender).
+		String(tx.Receiver).
+		Int(tx.Amount.Units).
+		String(tx.Amount.Asset).
+		String(tx.Invoice).
+		Encoded()
+}
+
+// newTransactionID returns a random transaction ID
+func newTransactionID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// validateTransactionID checks that <id> looks like an ID of
+// <newTransactionID>, so that IDs from other nodes cannot be used to mess
+// with the keys of the ledger database
+func validateTransactionID(id string) error {
+	data, err := hex.DecodeString(id)
+	if err != nil || len(data) != 16 {
+		return fmt.Errorf("invalid transaction ID %q", id)
+	}
+	return nil
+}
+
+// signTransaction signs <tx> with the private key of <node>
+func (node *PeerNode) signTransaction(tx *TransactionWrapper) error {
+	signature, publicKey, err := node.sign(tx.signingBytes())
+	if err != nil {
+		return err
+	}
+	tx.Signature = signature
+	tx.PublicKey = publicKey
+	return nil
+}
+
+// verifyTransaction checks that <tx> was signed by <remote>, the peer the
+// payment stream comes from. The peer ID in the <Sender> address has to be
+// <remote> as well, so a node cannot send a transaction in the name of
+// another node.
+// ----------------------------------------------------------------------------
+// It returns an error in case <tx> was not signed by <remote>.
+func verifyTransaction(remote peer.ID, tx *TransactionWrapper) error {
+	sender, err := IpfsAddressToPeerID(tx.Sender)
+	if err != nil {
+		return fmt.Errorf("invalid sender %q: %s", tx.Sender, err)
+	}
+	if sender != remote {
+		return fmt.Errorf("sender %s does not match the peer of the stream %s", sender.Pretty(), remote.Pretty())
+	}
+	err = verifySignature(remote, tx.signingBytes(), tx.Signature, tx.PublicKey)
+	if err != nil {
+		return fmt.Errorf("transaction: %s", err)
+	}
+	return nil
 }
 
 // TransactionStream is a struct that is used to wrap a <net.Stream> stream.
@@ -86,89 +248,285 @@ func WrapTransactionStream(stream net.Stream) *TransactionStream {
 	}
 }
 
-// sendTransaction is the function in which a <TransactionWrapper>
-// struct is created and written to a <TransactionStream>
+// sendTransaction is the function in which a signed <TransactionWrapper>
+// is written to a <TransactionStream>
 // ----------------------------------------------------------------------------
 // <wrappedTransactionStream> is a receiver of pointer type to <TransactionStream>.It is
 // the Wrapped stream that the Transsaction will be written to so that it
 // can get transferred between nodes.
 // ----------------------------------------------------------------------------
-// <sender>,<receiver> and <amount> are parameters that are used to create the
-// <TransactionWrapper> and write it to <wrappedTransactionStream>
+// <tx> is a parameter of pointer type to <TransactionWrapper> that is
+// written to <wrappedTransactionStream>. It has to be signed already.
 // ----------------------------------------------------------------------------
 // it returns an error if something goes wrong.
-func (wrappedTransactionStream *TransactionStream) sendTransaction(sender string, receiver string, amount float64) error {
-	// Use the functions input to create a <TransactionWrapper> called <tx>
-	tx := &TransactionWrapper{
-		Sender:   sender,
-		Receiver: receiver,
-		Amount:   amount,
-	}
+func (wrappedTransactionStream *TransactionStream) sendTransaction(tx *TransactionWrapper) error {
 	// use <wrappedTransactionStream.encoder> to encode <tx>
 	err := wrappedTransactionStream.encoder.Encode(tx)
+	if err != nil {
+		return err
+	}
 	// Write the transaction to the stream and since output is buffered with
 	// <bufio> so <Flush> has to get called before exit.
-	wrappedTransactionStream.writer.Flush()
-	return err
+	return wrappedTransactionStream.writer.Flush()
+}
+
+// readReceipt reads the receipt of the receiver node after the transaction
+// with <id> was sent.
+// ----------------------------------------------------------------------------
+// it returns the receipt
+// It returns a <TransactionRefused> error in case the receiver refused the
+// transaction, and any other error in case no receipt for <id> came.
+func (wrappedTransactionStream *TransactionStream) readReceipt(id string) (*TransactionReceipt, error) {
+	var receipt TransactionReceipt
+	err := wrappedTransactionStream.decoder.Decode(&receipt)
+	if err == io.EOF {
+		return nil, fmt.Errorf("the receiver closed the stream without a receipt")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if receipt.ID != id {
+		return nil, fmt.Errorf("the receipt is for transaction %q instead of %q", receipt.ID, id)
+	}
+	if !receipt.Accepted {
+		return nil, &TransactionRefused{Receipt: &receipt}
+	}
+	return &receipt, nil
+}
+
+// sendReceipt writes <receipt> back to the sender and closes the stream
+func (wrappedTransactionStream *TransactionStream) sendReceipt(receipt *TransactionReceipt) {
+	if !receipt.Accepted {
+		fmt.Printf("Payment refused (%s): %s\n", receipt.Code, receipt.Reason)
+	}
+	err := wrappedTransactionStream.encoder.Encode(receipt)
+	if err == nil {
+		err = wrappedTransactionStream.writer.Flush()
+	}
+	if err != nil {
+		wrappedTransactionStream.stream.Reset()
+		return
+	}
+	wrappedTransactionStream.stream.Close()
+}
+
+// refuseTransaction sends a receipt that refuses the transaction with <id>
+// for <reason>
+func (wrappedTransactionStream *TransactionStream) refuseTransaction(id string, code ReceiptCode, reason error) {
+	wrappedTransactionStream.sendReceipt(&TransactionReceipt{ID: id, Code: code, Reason: reason.Error()})
 }
 
 // Payment is the main function that is used in payment
 // protocol to send a transaction to another node.
 // this function uses payment protocol to send the transaction
-// and pingProtocol protocol to receives confirmation of transaction.
+// and receives the receipt of the receiver node on the same stream.
 // ----------------------------------------------------------------------------
 // <node> is a receiver of pointer type to <PeerNode>.
 // <node> is the peer node that sends a transaction to another node
 // ----------------------------------------------------------------------------
 // <destination> is a parameter of string type that is the
 // IPFS address of the node that receiving the transaction
-// <amount> is a parameter of float64 type that represents the money
+// <amount> is a parameter of <Money> type that represents the money
 // getting transfered
-func (node *PeerNode) Payment(destination string, amount float64) {
+func (node *PeerNode) Payment(destination string, amount Money) {
+	_, err := node.sendPayment(destination, amount, "")
+	if err != nil {
+		fmt.Println("Payment refused:", err)
+	}
+}
+
+// sendPayment sends <amount> to <destination> like <Payment> and names the
+// invoice with ID <invoice> in the transaction, unless it is empty.
+// ----------------------------------------------------------------------------
+// it returns the receipt of the receiver node.
+// It returns an error in case the payment was refused or could not be
+// delivered.
+func (node *PeerNode) sendPayment(destination string, amount Money, invoice string) (*TransactionReceipt, error) {
 	// First, we add the peer node <destination> string points to
 	// <node> local address book
 	peerID, err := addAddressToPeerstore(node, destination)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	err = node.assets.Validate(amount)
+	if err != nil {
+		return nil, err
+	}
+	// the payment is refused before anything is sent if it would take our
+	// balance with the receiver node past the credit limit
+	if node.ledger != nil {
+		err = node.ledger.CheckDebit(peerID, amount)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// it gets the <node> address that other nodes are most likely able to
+	// reach as an IPFS address string and store it in variable <sender>
+	sender := node.advertisedAddress()
+	// the transaction gets an ID and the next nonce of <node>, and it is
+	// signed with the private key of <node>, so the receiver node can
+	// check that it really comes from us and book it only once
+	id, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := node.nextNonce()
+	if err != nil {
+		return nil, err
+	}
+	tx := &TransactionWrapper{
+		ID:       id,
+		Nonce:    nonce,
+		Sender:   sender,
+		Receiver: destination,
+		Amount:   amount,
+		Invoice:  invoice,
+	}
+	err = node.signTransaction(tx)
+	if err != nil {
+		return nil, err
+	}
+	// the same signed transaction is sent again when the stream breaks
+	// before the receipt came. The receiver node books it only once and
+	// answers a retry with the receipt of the first attempt, so retrying is
+	// safe.
+	var receipt *TransactionReceipt
+	for attempt := 1; ; attempt++ {
+		receipt, err = node.deliverTransaction(peerID, tx)
+		if err == nil {
+			break
+		}
+		refused, ok := err.(*TransactionRefused)
+		if (ok && !refused.Temporary()) || attempt == maxPaymentAttempts {
+			return nil, err
+		}
+		fmt.Printf("Payment %s: attempt %d failed: %s\n", tx.ID, attempt, err)
+		time.Sleep(time.Duration(attempt) * paymentRetryDelay)
+	}
+
+	fmt.Printf("\nTransaction %s accepted\n %s => %s\n", receipt.ID, node.ID().String(), peerID)
+	if receipt.Balance != nil {
+		fmt.Printf("Balance of the receiver with us: %s\n", node.assets.Format(*receipt.Balance))
+	}
+	// the signed receipt is kept as a proof of payment. The payment went
+	// through either way, so a receipt that does not check out is only
+	// reported.
+	node.keepReceipt(peerID, tx, receipt)
+	// the payment is booked as a debit with the receiver node. The credit
+	// limit was checked before sending, and the receiver accepted, so the
+	// debit is booked even if another payment moved the balance since. The
+	// payment went through, so a ledger error is only reported.
+	if node.ledger != nil {
+		entry, err := node.ledger.Debit(peerID, amount)
+		if err != nil {
+			fmt.Println("Ledger:", err)
+			return receipt, nil
+		}
+		fmt.Printf("Balance with %s: %s\n", peerID, node.assets.Format(Money{Units: entry.Balance, Asset: entry.Asset}))
+	}
+	return receipt, nil
+}
+
+// nextNonce returns the nonce of our next transaction. It is higher than
+// the nonce of every transaction we sent before. Without a ledger the
+// nonces start at the time the node started, so they only keep growing
+// across restarts as long as the clock does not go back.
+func (node *PeerNode) nextNonce() (uint64, error) {
+	nonce := atomic.AddUint64(&node.transactionNonce, 1)
+	if node.ledger == nil {
+		return nonce, nil
+	}
+	return node.ledger.NextNonce(nonce)
+}
+
+// receivedTransactions is a struct that keeps the result of every
+// transaction received by a node without a ledger and the last nonce of
+// every sender, like the ledger does, so that a replay is refused there
+// too. It only lasts as long as the node runs, but nothing is booked
+// without a ledger either.
+type receivedTransactions struct {
+	mutex   sync.Mutex
+	results map[string]*TransactionResult
+	nonces  map[peer.ID]uint64
+}
+
+// newReceivedTransactions creates an empty <receivedTransactions>
+func newReceivedTransactions() *receivedTransactions {
+	return &receivedTransactions{
+		results: make(map[string]*TransactionResult),
+		nonces:  make(map[peer.ID]uint64),
+	}
+}
+
+// Receive decides about a transaction from <peerID> like <Ledger.Receive>,
+// without booking it.
+func (received *receivedTransactions) Receive(peerID peer.ID, transaction *TransactionWrapper) *TransactionResult {
+	received.mutex.Lock()
+	defer received.mutex.Unlock()
+	key := peer.IDB58Encode(peerID) + "/" + transaction.ID
+	if result, ok := received.results[key]; ok {
+		duplicate := *result
+		duplicate.Duplicate = true
+		return &duplicate
+	}
+	last := received.nonces[peerID]
+	if transaction.Nonce <= last {
+		return &TransactionResult{
+			ID:     transaction.ID,
+			Nonce:  transaction.Nonce,
+			Time:   time.Now(),
+			Code:   ReceiptReplay,
+			Reason: fmt.Sprintf("nonce %d is not higher than the last nonce %d, the transaction is a replay or out of order", transaction.Nonce, last),
+		}
+	}
+	result := &TransactionResult{
+		ID:       transaction.ID,
+		Nonce:    transaction.Nonce,
+		Time:     time.Now(),
+		Accepted: true,
+		Code:     ReceiptAccepted,
 	}
+	received.nonces[peerID] = transaction.Nonce
+	received.results[key] = result
+	return result
+}
+
+// deliverTransaction sends <tx> to <peerID> on a new payment stream and
+// waits for the receipt of the receiver node.
+// ----------------------------------------------------------------------------
+// it returns the receipt of an accepted transaction
+// It returns a <TransactionRefused> error in case the receiver node refused
+// <tx>, and any other error in case the stream broke before the receipt
+// came, in which case <tx> can be sent again.
+func (node *PeerNode) deliverTransaction(peerID peer.ID, tx *TransactionWrapper) (*TransactionReceipt, error) {
 	// <node> creates a news tream by calling  <NewStream>
-	// function and passing background context, receiver's
-	// <peerID> and <paymentProtocol> (<"/payment/1.0.0">)
-	stream, err := node.NewStream(context.Background(), peerID, paymentProtocol)
+	// function and passing a relay friendly context, receiver's
+	// <peerID> and <paymentProtocol> (<"/payment/2.0.0">)
+	stream, err := node.NewStream(streamContext(paymentProtocol), peerID, paymentProtocol)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	stream.SetDeadline(time.Now().Add(paymentTimeout))
 	// use <WrapTransactionStream (stream net.Stream)> function to wrap
 	// <stream> stream and save it in variable <wrappedTransactionStream>
 	wrappedTransactionStream := WrapTransactionStream(stream)
-	// it gets the <node> address and turns it into a default
-	// IPFS address string and store it in variable <sender>
-	sender := node.Addrs()[0].String()
-	sender = fmt.Sprintf("%s/ipfs/%s", sender, node.ID().Pretty())
-	// use <sendTransaction(sender string, receiver string, amount float64)>
-	// on <wrappedTransactionStream> to send the transaction to receiver node.
-	wrappedTransactionStream.sendTransaction(sender, destination, amount)
-	// <node> creates a new stream  and storing it in variable <replyStream>
-	// by calling  <NewStream> function and passing background context, receiver's
-	// <peerID> and <pingProtocol> (<"/ping/1.0.0">)
-	replyStream, err := node.NewStream(context.Background(), peerID, pingProtocol)
-	if err != nil {
-		panic(err)
-	}
-	// it reads back the <replyStream>. If the stream is sent
-	// successfully,the stream is modified on the receiver node
-	// so <ioutil.ReadAll()> is used to read back the
-	// stream's content again confirm the receivers message that it recieved
-	// the transaction.
-	reply, err := ioutil.ReadAll(replyStream)
-	if err != nil {
-		panic(err)
-	}
-
-	fmt.Printf("%s\n %s => %s\n", reply, node.ID().String(), peerID)
-	// close the stream
+	// use <sendTransaction(tx *TransactionWrapper)> on
+	// <wrappedTransactionStream> to send the transaction to receiver node.
+	err = wrappedTransactionStream.sendTransaction(tx)
+	if err != nil {
+		stream.Reset()
+		return nil, err
+	}
+	// our side of the stream is closed so that the receiver node knows the
+	// transaction is complete, and then we wait for its receipt
+	stream.CloseWrite()
+	receipt, err := wrappedTransactionStream.readReceipt(tx.ID)
+	if err != nil {
+		stream.Reset()
+		return nil, err
+	}
 	stream.Close()
-
+	return receipt, nil
 }
 
 // decodeTransaction is used to decode a <*TransactionStream> into <*TransactionWrapper>
@@ -190,31 +548,11 @@ func (wrappedTransactionStream *TransactionStream) decodeTransaction() (*Transac
 	return &tx, nil
 }
 
-// PaymentProtocolMultiplexer : Multiplexes "/payment/1.0.0"
-// and /ping/1.0.0 to a node and takes care of the way nodes behave when they
-// receive a stream of payment protocol and ping protocol.
+// PaymentProtocolMultiplexer : Multiplexes "/payment/2.0.0"
+// to a node and takes care of the way nodes behave when they
+// receive a stream of payment protocol.
 // It is called to initialize payment protocol before any other function
 func (node *PeerNode) PaymentProtocolMultiplexer() {
-	// <SetStreamHandler> function takes a string
-	// (<pingProtocol>) and an anonymous function that
-	// takes a <net.stream> struct and Multiplexes the string
-	// to that anonymous functions code so whenever a stream
-	// with the same string attached is received,that code
-	// inside anonymous function is executed
-	node.SetStreamHandler(pingProtocol, func(stream net.Stream) {
-		// It prepares the <message> to get send back to the node that
-		// sent the transaction
-		message := fmt.Sprintf("\nTransaction Successful \t Thank You!\n")
-		// it writes the <message> to stream in byte array
-		// format so that the byte array is sent back to
-		// the sender node
-		_, err := stream.Write([]byte(message))
-		if err != nil {
-			panic(err)
-		}
-		stream.Close()
-
-	})
 	// <SetStreamHandler> function takes a string
 	// (<paymentProtocol>) and an anonymous function that
 	// takes a <net.stream> struct and Multiplexes the string
@@ -222,6 +560,12 @@ func (node *PeerNode) PaymentProtocolMultiplexer() {
 	// with the same string attached is received by a node,that code
 	// inside anonymous function is executed on the receiver node
 	node.SetStreamHandler(paymentProtocol, func(stream net.Stream) {
+		// refuse the stream if the remote peer is not allowed to use
+		// this protocol
+		if !node.streamAllowed(paymentProtocol, stream.Conn().RemotePeer()) {
+			stream.Reset()
+			return
+		}
 		fmt.Println("Request Receiver : New connection intiated")
 		// it uses <WrapTransactionStream (stream net.Stream)> function to wrap
 		// <stream> stream and save it in variable <wrappedTransactionStream>
@@ -230,19 +574,80 @@ func (node *PeerNode) PaymentProtocolMultiplexer() {
 		// stream and store it in variable <tx>
 		tx, err := wrappedTransactionStream.decodeTransaction()
 		if err != nil {
-			// if transaction cannot be extracted, show the error and reset
-			// the stream
-			fmt.Println(err)
-			wrappedTransactionStream.stream.Reset()
+			// if transaction cannot be extracted, refuse it without an ID
+			wrappedTransactionStream.refuseTransaction("", ReceiptMalformed, err)
+			return
+		}
+		err = validateTransactionID(tx.ID)
+		if err == nil && tx.Invoice != "" {
+			err = validateTransactionID(tx.Invoice)
+		}
+		if err != nil {
+			wrappedTransactionStream.refuseTransaction(tx.ID, ReceiptMalformed, err)
+			return
+		}
+		// the transaction has to be signed by the peer the stream
+		// comes from, otherwise it is refused
+		remote := stream.Conn().RemotePeer()
+		err = verifyTransaction(remote, tx)
+		if err != nil {
+			wrappedTransactionStream.refuseTransaction(tx.ID, ReceiptBadSignature, err)
+			return
+		}
+		// the amount has to be positive and in an asset we accept
+		err = node.assets.Validate(tx.Amount)
+		if err != nil {
+			wrappedTransactionStream.refuseTransaction(tx.ID, ReceiptInvalidAmount, err)
+			return
+		}
+		// the payment is booked as a credit with the sender. If it
+		// would take the balance past the credit limit, or it is a
+		// replay, the payment is refused. A transaction that was
+		// received before gets the same receipt again. The receipt is
+		// only sent once the result is stored. Without a ledger nothing
+		// is booked, but replays are still refused.
+		var result *TransactionResult
+		if node.ledger != nil {
+			result, err = node.ledger.Receive(remote, tx)
+			if err != nil {
+				fmt.Println("Ledger:", err)
+				wrappedTransactionStream.refuseTransaction(tx.ID, ReceiptInternalError, fmt.Errorf("the transaction could not be stored"))
+				return
+			}
 		} else {
-			// if transaction is extracted, show the amount and
-			// close the stream
-			fmt.Printf("**********************************************************\n")
-			fmt.Printf("Recieved Amount: %f\n", tx.Amount)
-			fmt.Printf("**********************************************************\n")
-			stream.Close()
+			result = node.received.Receive(remote, tx)
+		}
+		receipt := result.Receipt()
+		if !receipt.Accepted {
+			wrappedTransactionStream.sendReceipt(receipt)
+			return
+		}
+		// the receipt of an accepted transaction is signed, so that the
+		// sender can prove it paid us. A retry gets a signed receipt too,
+		// with the time of the first one, since the sender may never have
+		// seen the first receipt.
+		err = node.signReceipt(receipt, remote, tx)
+		if err != nil {
+			fmt.Println("Receipt:", err)
+		}
+		if result.Duplicate {
+			fmt.Printf("Transaction %s was received before, it is not booked again\n", tx.ID)
+			wrappedTransactionStream.sendReceipt(receipt)
+			return
+		}
+		// if transaction is accepted, show the amount and
+		// send the receipt
+		fmt.Printf("**********************************************************\n")
+		fmt.Printf("Recieved Amount: %s\n", node.assets.Format(tx.Amount))
+		fmt.Printf("Transaction ID: %s\n", tx.ID)
+		if tx.Invoice != "" {
+			fmt.Printf("Invoice %s paid\n", tx.Invoice)
 		}
+		fmt.Printf("**********************************************************\n")
+		wrappedTransactionStream.sendReceipt(receipt)
 
 	})
-	fmt.Printf("Payment Protocol 1.0.0 Multiplexd!\n")
+	// payment channels run next to single payments
+	node.SetStreamHandler(channelProtocol, node.handleChannel)
+	fmt.Printf("Payment Protocol 2.0.0 Multiplexd!\n")
 }
@@ -0,0 +1,394 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// defaultPresenceTopic is the pubsub topic presence heartbeats are published
+// to when the config does not name one
+const defaultPresenceTopic = "/libp2p-examples/presence/1.0.0"
+
+// presenceEvaluateInterval is how often the presence table checks for
+// peers that stopped publishing
+const presenceEvaluateInterval = time.Second
+
+// PresenceBeat is the heartbeat a node publishes to the presence topic.
+// <Timestamp> is the time it was published in Unix nanoseconds and
+// <Interval> tells the other nodes how often to expect the next one.
+type PresenceBeat struct {
+	Peer      string
+	Seq       uint64
+	Timestamp int64
+	Interval  Duration
+	Addrs     []string
+}
+
+// Presence is a struct that runs heartbeats over pubsub: every node
+// publishes a signed heartbeat to one topic and builds a presence table
+// from the heartbeats of the others. Each node sends one message per
+// interval no matter how large the cluster is, instead of one heartbeat to
+// every other node.
+// The table uses the states and the <PeerStatus> of the heartbeat monitor,
+// a peer is suspected or down after it missed <SuspectAfter> or
+// <DownAfter> of the heartbeats it announced.
+type Presence struct {
+	node         *PeerNode
+	topicName    string
+	interval     time.Duration
+	maxInterval  time.Duration
+	suspectAfter int
+	downAfter    int
+
+	mutex        sync.RWMutex
+	pubsub       *pubsub.PubSub
+	topic        *pubsub.Topic
+	subscription *pubsub.Subscription
+	cancel       context.CancelFunc
+	seq          uint64
+	peers        map[peer.ID]*PeerStatus
+	// latest holds the signed timestamp of the newest heartbeat of every
+	// peer. It only orders the heartbeats, the table uses our own clock.
+	latest      map[peer.ID]time.Time
+	subscribers []chan StateTransition
+}
+
+// NewPresence creates the presence mode of <node>. Nothing is published
+// until <Start> is called.
+// ----------------------------------------------------------------------------
+// <config> is a parameter of pointer type to <Config> that holds the topic,
+// the interval and the thresholds.
+func NewPresence(node *PeerNode, config *Config) *Presence {
+	topicName := config.PresenceTopic
+	if topicName == "" {
+		topicName = defaultPresenceTopic
+	}
+	interval := config.PresenceInterval.Duration
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	// our own interval is always accepted from the others
+	maxInterval := config.PresenceMaxInterval.Duration
+	if maxInterval < interval {
+		maxInterval = interval
+	}
+	return &Presence{
+		node:         node,
+		topicName:    topicName,
+		interval:     interval,
+		maxInterval:  maxInterval,
+		suspectAfter: config.SuspectAfter,
+		downAfter:    config.DownAfter,
+		peers:        make(map[peer.ID]*PeerStatus),
+		latest:       make(map[peer.ID]time.Time),
+	}
+}
+
+// Start joins the presence topic, starts publishing heartbeats and
+// listening to the heartbeats of others. Calling it on a running presence
+// does nothing.
+// ----------------------------------------------------------------------------
+// It returns an error in case pubsub could not be set up or the topic
+// could not be joined.
+func (presence *Presence) Start() error {
+	presence.mutex.Lock()
+	defer presence.mutex.Unlock()
+	if presence.cancel != nil {
+		return nil
+	}
+	// pubsub is created once and kept, since it cannot be attached to a
+	// host twice. Every message is signed by its author and messages with
+	// a missing or wrong signature are dropped, so a heartbeat cannot be
+	// published in the name of another node.
+	if presence.pubsub == nil {
+		ps, err := pubsub.NewGossipSub(context.Background(), presence.node,
+			pubsub.WithMessageSigning(true),
+			pubsub.WithStrictSignatureVerification(true))
+		if err != nil {
+			return err
+		}
+		presence.pubsub = ps
+	}
+	err := presence.pubsub.RegisterTopicValidator(presence.topicName, presence.validate)
+	if err != nil {
+		return err
+	}
+	topic, err := presence.pubsub.Join(presence.topicName)
+	if err != nil {
+		presence.pubsub.UnregisterTopicValidator(presence.topicName)
+		return err
+	}
+	subscription, err := topic.Subscribe()
+	if err != nil {
+		topic.Close()
+		presence.pubsub.UnregisterTopicValidator(presence.topicName)
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	presence.topic = topic
+	presence.subscription = subscription
+	presence.cancel = cancel
+	go presence.publish(ctx, topic)
+	go presence.listen(ctx, subscription)
+	go presence.evaluate(ctx)
+	return nil
+}
+
+// Stop stops publishing and leaves the presence topic. The table is kept.
+func (presence *Presence) Stop() {
+	presence.mutex.Lock()
+	defer presence.mutex.Unlock()
+	if presence.cancel == nil {
+		return
+	}
+	presence.cancel()
+	presence.subscription.Cancel()
+	presence.topic.Close()
+	presence.pubsub.UnregisterTopicValidator(presence.topicName)
+	presence.cancel = nil
+	presence.topic = nil
+	presence.subscription = nil
+}
+
+// Active reports whether <presence> is running
+func (presence *Presence) Active() bool {
+	presence.mutex.RLock()
+	defer presence.mutex.RUnlock()
+	return presence.cancel != nil
+}
+
+// Subscribe returns a channel that receives every state transition of the
+// presence table from now on. Slow readers miss transitions instead of
+// blocking the table.
+func (presence *Presence) Subscribe() <-chan StateTransition {
+	presence.mutex.Lock()
+	defer presence.mutex.Unlock()
+	subscriber := make(chan StateTransition, 64)
+	presence.subscribers = append(presence.subscribers, subscriber)
+	return subscriber
+}
+
+// publish sends a heartbeat to the topic right away and then once per
+// interval until <ctx> is done
+func (presence *Presence) publish(ctx context.Context, topic *pubsub.Topic) {
+	ticker := time.NewTicker(presence.interval)
+	defer ticker.Stop()
+	for {
+		presence.mutex.Lock()
+		presence.seq++
+		beat := PresenceBeat{
+			Peer:      peer.IDB58Encode(presence.node.ID()),
+			Seq:       presence.seq,
+			Timestamp: time.Now().UnixNano(),
+			Interval:  Duration{presence.interval},
+		}
+		presence.mutex.Unlock()
+		for _, address := range presence.node.Addrs() {
+			beat.Addrs = append(beat.Addrs, address.String())
+		}
+		data, err := json.Marshal(beat)
+		if err == nil {
+			err = topic.Publish(ctx, data)
+		}
+		if err != nil && ctx.Err() == nil {
+			fmt.Println("Presence:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// validate is the topic validator of the presence topic. Pubsub already
+// checked the signature of the message against its author, so here the
+// heartbeat has to name the same author, the author has to be allowed by
+// the access control list and the timestamp has to be close to our clock.
+// Messages that fail are dropped and not forwarded to other nodes.
+func (presence *Presence) validate(ctx context.Context, from peer.ID, message *pubsub.Message) bool {
+	author := message.GetFrom()
+	if !presence.node.streamAllowed(presence.topicName, author) {
+		return false
+	}
+	var beat PresenceBeat
+	if json.Unmarshal(message.Data, &beat) != nil {
+		return false
+	}
+	if beat.Peer != peer.IDB58Encode(author) || beat.Interval.Duration <= 0 || beat.Interval.Duration > presence.maxInterval {
+		return false
+	}
+	skew := time.Since(time.Unix(0, beat.Timestamp))
+	return skew <= maxHeartbeatClockSkew && skew >= -maxHeartbeatClockSkew
+}
+
+// listen reads the heartbeats of the topic until <ctx> is done
+func (presence *Presence) listen(ctx context.Context, subscription *pubsub.Subscription) {
+	for {
+		message, err := subscription.Next(ctx)
+		if err != nil {
+			return
+		}
+		author := message.GetFrom()
+		if author == presence.node.ID() {
+			continue
+		}
+		var beat PresenceBeat
+		if json.Unmarshal(message.Data, &beat) != nil {
+			continue
+		}
+		presence.record(author, beat)
+	}
+}
+
+// record updates the presence table with a heartbeat of <peerID>. Older
+// heartbeats that arrive late and heartbeats that are replayed are ignored.
+// The signed timestamp of the sender is only used for that, the table holds
+// the time we received the heartbeat, so a peer with a clock that runs
+// ahead cannot keep itself up after it stopped publishing.
+func (presence *Presence) record(peerID peer.ID, beat PresenceBeat) {
+	presence.mutex.Lock()
+	defer presence.mutex.Unlock()
+	sent := time.Unix(0, beat.Timestamp)
+	if !sent.After(presence.latest[peerID]) {
+		return
+	}
+	presence.latest[peerID] = sent
+	status, ok := presence.peers[peerID]
+	if !ok {
+		status = &PeerStatus{Peer: peerID}
+		presence.peers[peerID] = status
+	}
+	// <validate> drops heartbeats with a longer interval already, the
+	// interval is capped here too so the table never trusts more than
+	// <maxInterval>
+	interval := beat.Interval.Duration
+	if interval > presence.maxInterval {
+		interval = presence.maxInterval
+	}
+	now := time.Now()
+	status.LastSeen = now
+	status.LastChecked = now
+	status.Interval = interval
+	status.NextCheck = now.Add(interval)
+	status.Authenticated = true
+	status.Successes++
+	status.Failures = 0
+	status.LastError = ""
+	if len(beat.Addrs) > 0 {
+		status.Address = fmt.Sprintf("%s/ipfs/%s", beat.Addrs[0], beat.Peer)
+	}
+	presence.transitionLocked(status, PeerUp, now)
+}
+
+// evaluate counts the heartbeats every peer missed once per
+// <presenceEvaluateInterval> until <ctx> is done
+func (presence *Presence) evaluate(ctx context.Context) {
+	ticker := time.NewTicker(presenceEvaluateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		presence.mutex.Lock()
+		for _, status := range presence.peers {
+			// a heartbeat counts as missed once it is half an interval
+			// late, so a little jitter does not make a peer suspect
+			late := now.Sub(status.LastSeen) - status.Interval/2
+			missed := 0
+			if late > 0 {
+				missed = int(late / status.Interval)
+			}
+			status.LastChecked = now
+			if missed == 0 {
+				continue
+			}
+			status.Failures = missed
+			status.Successes = 0
+			status.LastError = fmt.Sprintf("missed %d heartbeats", missed)
+			switch {
+			case missed >= presence.downAfter:
+				presence.transitionLocked(status, PeerDown, now)
+			case missed >= presence.suspectAfter:
+				presence.transitionLocked(status, PeerSuspect, now)
+			}
+		}
+		presence.mutex.Unlock()
+	}
+}
+
+// transitionLocked moves <status> to <state> and tells the subscribers if
+// that is a change
+func (presence *Presence) transitionLocked(status *PeerStatus, state PeerState, now time.Time) {
+	if status.State == state {
+		return
+	}
+	transition := StateTransition{
+		Peer:  status.Peer,
+		From:  status.State,
+		To:    state,
+		Time:  now,
+		Error: status.LastError,
+	}
+	status.State = state
+	for _, subscriber := range presence.subscribers {
+		select {
+		case subscriber <- transition:
+		default:
+		}
+	}
+}
+
+// Snapshot returns a copy of the presence table, sorted by peer ID. It can
+// be shown with <FormatPeerStatusTable> like the table of the monitor.
+func (presence *Presence) Snapshot() []PeerStatus {
+	presence.mutex.RLock()
+	defer presence.mutex.RUnlock()
+	var result []PeerStatus
+	for _, status := range presence.peers {
+		result = append(result, *status)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Peer < result[j].Peer
+	})
+	return result
+}
+
+// Presence returns the pubsub presence mode of <node>
+func (node *PeerNode) Presence() *Presence {
+	return node.presence
+}
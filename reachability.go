@@ -0,0 +1,186 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	autonat "github.com/libp2p/go-libp2p-autonat"
+	peer "github.com/libp2p/go-libp2p-peer"
+	multiaddr "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// dialBackTimeout is how long we wait for a helper peer to dial us back
+const dialBackTimeout = 30 * time.Second
+
+// Reachability tells whether other nodes can dial one of our addresses
+type Reachability int
+
+const (
+	// ReachabilityUnknown means no helper could tell us anything about the
+	// address
+	ReachabilityUnknown Reachability = iota
+	// ReachabilityPublic means a helper peer dialed the address successfully
+	ReachabilityPublic
+	// ReachabilityPrivate means the address is a loopback or private address,
+	// or that helper peers tried to dial it and failed
+	ReachabilityPrivate
+)
+
+// String returns the name of <reachability> as it is shown in the shell
+func (reachability Reachability) String() string {
+	switch reachability {
+	case ReachabilityPublic:
+		return "public"
+	case ReachabilityPrivate:
+		return "private"
+	default:
+		return "unknown"
+	}
+}
+
+// AddressReachability is a struct that holds the result of the reachability
+// check of one of our listen addresses.
+// <CheckedBy> is the helper peer that dialed the address successfully, it is
+// empty if no helper could.
+type AddressReachability struct {
+	Address      multiaddr.Multiaddr
+	Reachability Reachability
+	CheckedBy    peer.ID
+}
+
+// CheckReachability asks helper peers to dial back to every listen address of
+// <node> and records for each address whether it is publicly reachable,
+// private or unknown. Helpers have to run the AutoNAT service, which every
+// node of this repo does.
+// The result is kept on <node> and decides which address is advertised in
+// payments and in the startup banner.
+// ----------------------------------------------------------------------------
+// <node> is a receiver of pointer type to <PeerNode>.
+// <helpers> is a parameter of array of strings type that holds the IPFS
+// addresses of the helper peers. If it is empty, the peers <node> is
+// connected to are asked.
+// ----------------------------------------------------------------------------
+// it returns an array of <AddressReachability> with one entry per address.
+func (node *PeerNode) CheckReachability(helpers []string) []AddressReachability {
+	var helperIDs []peer.ID
+	for _, helper := range helpers {
+		helperID, err := addAddressToPeerstore(node, helper)
+		if err != nil {
+			fmt.Printf("Helper %s: %s\n", helper, err)
+			continue
+		}
+		helperIDs = append(helperIDs, helperID)
+	}
+	if len(helpers) == 0 {
+		helperIDs = node.Network().Peers()
+	}
+	var result []AddressReachability
+	for _, address := range node.Addrs() {
+		result = append(result, node.checkAddress(address, helperIDs))
+	}
+	node.reachabilityMutex.Lock()
+	node.reachability = result
+	node.reachabilityMutex.Unlock()
+	return result
+}
+
+// checkAddress asks every helper in turn to dial back to <address> until
+// one of them succeeds.
+func (node *PeerNode) checkAddress(address multiaddr.Multiaddr, helperIDs []peer.ID) AddressReachability {
+	result := AddressReachability{Address: address, Reachability: ReachabilityUnknown}
+	// Relay addresses depend on the relay and not on us
+	if isRelayedAddress(address) {
+		return result
+	}
+	// Nobody outside of our network can dial loopback and private
+	// addresses, and helpers refuse to try, so there is no need to ask.
+	if manet.IsIPLoopback(address) || manet.IsPrivateAddr(address) {
+		result.Reachability = ReachabilityPrivate
+		return result
+	}
+	// The client only hands <address> to the helper, so a successful dial
+	// back tells us exactly this address is reachable.
+	dialBackClient := autonat.NewAutoNATClient(node, func() []multiaddr.Multiaddr {
+		return []multiaddr.Multiaddr{address}
+	})
+	for _, helperID := range helperIDs {
+		ctx, cancel := context.WithTimeout(streamContext(autonat.AutoNATProto), dialBackTimeout)
+		_, err := dialBackClient.DialBack(ctx, helperID)
+		cancel()
+		if err == nil {
+			result.Reachability = ReachabilityPublic
+			result.CheckedBy = helperID
+			return result
+		}
+		// A dial error means the helper tried and could not reach us. Any
+		// other error (the helper refused, or could not be reached at all)
+		// tells us nothing about the address.
+		if autonat.IsDialError(err) {
+			result.Reachability = ReachabilityPrivate
+		}
+	}
+	return result
+}
+
+// advertisedAddress returns the IPFS address of <node> that other nodes are
+// most likely able to dial: an address that was found to be public, then the
+// address of a relay if a reachability check found no public address, then
+// any address that is not loopback, and only then a loopback address.
+// ----------------------------------------------------------------------------
+// <node> is a receiver of pointer type to <PeerNode>.
+// ----------------------------------------------------------------------------
+// it returns the address with the </ipfs/<peer ID>> part at its end
+func (node *PeerNode) advertisedAddress() string {
+	node.reachabilityMutex.RLock()
+	for _, checked := range node.reachability {
+		if checked.Reachability == ReachabilityPublic {
+			node.reachabilityMutex.RUnlock()
+			return fmt.Sprintf("%s/ipfs/%s", checked.Address, node.ID().Pretty())
+		}
+	}
+	if len(node.reachability) > 0 && len(node.circuitAddresses) > 0 {
+		circuitAddress := node.circuitAddresses[0]
+		node.reachabilityMutex.RUnlock()
+		return circuitAddress
+	}
+	node.reachabilityMutex.RUnlock()
+	addresses := node.Addrs()
+	// a node that does not listen at all can only be named by its peer ID
+	if len(addresses) == 0 {
+		return fmt.Sprintf("/ipfs/%s", node.ID().Pretty())
+	}
+	best := addresses[0]
+	for _, address := range addresses {
+		if !manet.IsIPLoopback(address) && !manet.IsIPUnspecified(address) && !isRelayedAddress(address) {
+			best = address
+			break
+		}
+	}
+	return fmt.Sprintf("%s/ipfs/%s", best, node.ID().Pretty())
+}
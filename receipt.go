@@ -0,0 +1,197 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// ProofOfPayment is what the sender of a payment keeps: the transaction it
+// signed and the receipt the receiver signed for it. Together they show who
+// paid whom how much and when, and neither side can deny its part.
+type ProofOfPayment struct {
+	Transaction *TransactionWrapper
+	Receipt     *TransactionReceipt
+}
+
+// transactionHash returns the hash a receipt refers to <tx> with. It
+// covers the same bytes as the signature of the sender.
+func transactionHash(tx *TransactionWrapper) string {
+	hash := sha256.Sum256(tx.signingBytes())
+	return hex.EncodeToString(hash[:])
+}
+
+// signingBytes returns the canonical encoding of <receipt> that the
+// receiver signs. <Balance>, <Reason> and the signature itself are not
+// covered.
+func (receipt *TransactionReceipt) signingBytes() []byte {
+	encoder := newCanonicalEncoder("libp2p-examples receipt").
+		String(receipt.ID).
+		String(string(receipt.Code)).
+		String(receipt.Transaction).
+		String(receipt.Payer).
+		String(receipt.Payee).
+		Int(receipt.Time.UnixNano())
+	if receipt.Amount != nil {
+		encoder.Int(receipt.Amount.Units).String(receipt.Amount.Asset)
+	}
+	return encoder.Encoded()
+}
+
+// signReceipt fills in the fields of the accepted <receipt> of <tx> from
+// <payer> and signs it with the private key of <node>
+func (node *PeerNode) signReceipt(receipt *TransactionReceipt, payer peer.ID, tx *TransactionWrapper) error {
+	amount := tx.Amount
+	receipt.Transaction = transactionHash(tx)
+	receipt.Amount = &amount
+	receipt.Payer = peer.IDB58Encode(payer)
+	receipt.Payee = peer.IDB58Encode(node.ID())
+	if receipt.Time.IsZero() {
+		receipt.Time = time.Now()
+	}
+	var err error
+	receipt.Signature, receipt.PublicKey, err = node.sign(receipt.signingBytes())
+	return err
+}
+
+// Verify checks that <receipt> was signed by its payee and accepts the
+// transaction.
+// ----------------------------------------------------------------------------
+// It returns an error in case the receipt does not accept a transaction or
+// its signature is not valid.
+func (receipt *TransactionReceipt) Verify() error {
+	if !receipt.Accepted || receipt.Amount == nil || receipt.Transaction == "" {
+		return fmt.Errorf("the receipt does not accept a transaction")
+	}
+	payee, err := peer.IDB58Decode(receipt.Payee)
+	if err != nil {
+		return fmt.Errorf("invalid payee %q: %s", receipt.Payee, err)
+	}
+	err = verifySignature(payee, receipt.signingBytes(), receipt.Signature, receipt.PublicKey)
+	if err != nil {
+		return fmt.Errorf("receipt: %s", err)
+	}
+	return nil
+}
+
+// Verify checks both halves of <proof>: the receipt has to be signed by the
+// payee, the transaction by the payer, and the receipt has to be about
+// exactly that transaction.
+// ----------------------------------------------------------------------------
+// It returns an error that says which check failed.
+func (proof *ProofOfPayment) Verify() error {
+	if proof.Receipt == nil || proof.Transaction == nil {
+		return fmt.Errorf("the proof needs a transaction and a receipt")
+	}
+	err := proof.Receipt.Verify()
+	if err != nil {
+		return err
+	}
+	tx := proof.Transaction
+	if proof.Receipt.ID != tx.ID || proof.Receipt.Transaction != transactionHash(tx) {
+		return fmt.Errorf("the receipt is for another transaction")
+	}
+	if *proof.Receipt.Amount != tx.Amount {
+		return fmt.Errorf("the receipt is for %d %s instead of %d %s",
+			proof.Receipt.Amount.Units, proof.Receipt.Amount.Asset, tx.Amount.Units, tx.Amount.Asset)
+	}
+	payer, err := peer.IDB58Decode(proof.Receipt.Payer)
+	if err != nil {
+		return fmt.Errorf("invalid payer %q: %s", proof.Receipt.Payer, err)
+	}
+	return verifyTransaction(payer, tx)
+}
+
+// Describe returns a short description of the verified <proof>, with the
+// amount written with the decimals of <assets>
+func (proof *ProofOfPayment) Describe(assets AssetRegistry) string {
+	return fmt.Sprintf("%s paid %s to %s at %s (transaction %s)",
+		proof.Receipt.Payer, assets.Format(*proof.Receipt.Amount),
+		proof.Receipt.Payee, proof.Receipt.Time.Format(time.RFC3339), proof.Receipt.ID)
+}
+
+// storeReceipt writes <proof> to <"<ReceiptsDirectory>/<transaction ID>.json">
+// ----------------------------------------------------------------------------
+// it returns the path of the file
+// It returns an error in case the file cannot be written.
+func (node *PeerNode) storeReceipt(proof *ProofOfPayment) (string, error) {
+	err := os.MkdirAll(node.receipts, 0700)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(proof, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(node.receipts, proof.Transaction.ID+".json")
+	return path, ioutil.WriteFile(path, data, 0600)
+}
+
+// LoadProofOfPayment reads a proof of payment that <storeReceipt> wrote
+// to <path>
+func LoadProofOfPayment(path string) (*ProofOfPayment, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	proof := &ProofOfPayment{}
+	err = json.Unmarshal(data, proof)
+	if err != nil {
+		return nil, err
+	}
+	return proof, nil
+}
+
+// keepReceipt checks the <receipt> <payee> sent for <tx> and stores it
+// together with <tx> when the node keeps receipts
+func (node *PeerNode) keepReceipt(payee peer.ID, tx *TransactionWrapper, receipt *TransactionReceipt) {
+	proof := &ProofOfPayment{Transaction: tx, Receipt: receipt}
+	err := proof.Verify()
+	if err == nil && receipt.Payee != peer.IDB58Encode(payee) {
+		err = fmt.Errorf("the receipt is signed by %s instead of %s", receipt.Payee, payee.Pretty())
+	}
+	if err != nil {
+		fmt.Println("Receipt:", err)
+		return
+	}
+	if node.receipts == "" {
+		return
+	}
+	path, err := node.storeReceipt(proof)
+	if err != nil {
+		fmt.Println("Receipt:", err)
+		return
+	}
+	fmt.Printf("Receipt:\t%s\n", path)
+}
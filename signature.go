@@ -0,0 +1,131 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	crypto "github.com/libp2p/go-libp2p-crypto"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// sign signs <data> with the private key of <node>.
+// ----------------------------------------------------------------------------
+// it returns the signature and the public key to check it with. The key is
+// sent along so that peers whose key cannot be derived from their peer ID,
+// like our RSA keys, can still be checked.
+func (node *PeerNode) sign(data []byte) ([]byte, []byte, error) {
+	privateKey := node.Peerstore().PrivKey(node.ID())
+	if privateKey == nil {
+		return nil, nil, fmt.Errorf("no private key for %s", node.ID())
+	}
+	signature, err := privateKey.Sign(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	publicKey, err := crypto.MarshalPublicKey(privateKey.GetPublic())
+	if err != nil {
+		return nil, nil, err
+	}
+	return signature, publicKey, nil
+}
+
+// verifySignature checks that <signature> of <data> was made by <peerID>.
+// The <publicKey> that comes with the signature has to be the key <peerID>
+// was made from, otherwise anyone could sign with a key of their own.
+// ----------------------------------------------------------------------------
+// It returns an error in case the key does not belong to <peerID> or the
+// signature is not valid.
+func verifySignature(peerID peer.ID, data []byte, signature []byte, publicKey []byte) error {
+	if len(signature) == 0 {
+		return fmt.Errorf("missing signature of %s", peerID)
+	}
+	key, err := crypto.UnmarshalPublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	if !peerID.MatchesPublicKey(key) {
+		return fmt.Errorf("signed by a key that does not belong to %s", peerID)
+	}
+	ok, err := key.Verify(data, signature)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("invalid signature of %s", peerID)
+	}
+	return nil
+}
+
+// canonicalEncoder writes values in one fixed byte layout, so that both
+// sides of a signature get the same bytes no matter how the message was
+// encoded on the wire. Every value has a type tag and strings and byte
+// slices are prefixed with their length, so two different messages can
+// never encode to the same bytes.
+type canonicalEncoder struct {
+	buffer bytes.Buffer
+}
+
+// newCanonicalEncoder starts an encoding with <domain>, which tells what
+// kind of message is signed
+func newCanonicalEncoder(domain string) *canonicalEncoder {
+	encoder := &canonicalEncoder{}
+	encoder.String(domain)
+	return encoder
+}
+
+// String adds <value> to the encoding
+func (encoder *canonicalEncoder) String(value string) *canonicalEncoder {
+	return encoder.Bytes([]byte(value))
+}
+
+// Bytes adds <value> to the encoding
+func (encoder *canonicalEncoder) Bytes(value []byte) *canonicalEncoder {
+	encoder.buffer.WriteByte('b')
+	binary.Write(&encoder.buffer, binary.BigEndian, uint32(len(value)))
+	encoder.buffer.Write(value)
+	return encoder
+}
+
+// Int adds <value> to the encoding
+func (encoder *canonicalEncoder) Int(value int64) *canonicalEncoder {
+	encoder.buffer.WriteByte('i')
+	binary.Write(&encoder.buffer, binary.BigEndian, value)
+	return encoder
+}
+
+// Uint adds <value> to the encoding
+func (encoder *canonicalEncoder) Uint(value uint64) *canonicalEncoder {
+	encoder.buffer.WriteByte('u')
+	binary.Write(&encoder.buffer, binary.BigEndian, value)
+	return encoder
+}
+
+// Encoded returns the bytes of the encoding
+func (encoder *canonicalEncoder) Encoded() []byte {
+	return encoder.buffer.Bytes()
+}
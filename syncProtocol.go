@@ -26,10 +26,10 @@ package main
 
 import (
 	"bufio"
-	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 
 	"github.com/libp2p/go-libp2p-net"
 	"github.com/mholt/archiver"
@@ -76,9 +76,12 @@ func WrapDataStream(stream net.Stream) *DataStream {
 // <wrappedDataStream> is a receiver of pointer type to <DataStream>.It is
 // the Wrapped stream that the file was written to so that it
 // can get transferred between nodes and is ready to get decoded.
+// <directory> is where the zip file is stored and extracted. When it is
+// empty the working directory is used.
 // ----------------------------------------------------------------------------
 // It returns an erro in case something goes wrong.
-func (wrappedDataStream *DataStream) decodeTransfer() error {
+func (wrappedDataStream *DataStream) decodeTransfer(directory string) error {
+	zipFile := filepath.Join(directory, "data.zip")
 	// initialize variable <file> as an array of bytes
 	var file []byte
 	// use <wrappedDataStream.encoder> to decode and store to <file>
@@ -88,24 +91,24 @@ func (wrappedDataStream *DataStream) decodeTransfer() error {
 	}
 	// use <ioutil.WriteFile> to write <file> byte array to disk as the zip file
 	// it originated from.
-	err = ioutil.WriteFile("data.zip", file, 0644)
+	err = ioutil.WriteFile(zipFile, file, 0644)
 	// if there is an error, remove the zip file and return an error
 	if err != nil {
-		os.Remove("data.zip")
+		os.Remove(zipFile)
 		return (err)
 	}
 	// use <archiver> package to unzip the zip file that was transferred in
 	// the stream and was stored on disk.
-	err = archiver.Zip.Open("data.zip", "")
+	err = archiver.Zip.Open(zipFile, directory)
 	// If there is an error, remove the zip file and < /data > directory in
 	// which contents of the file were supposed to get unzipped to.
 	if err != nil {
-		os.Remove("data.zip")
-		os.Remove("data")
+		os.Remove(zipFile)
+		os.Remove(filepath.Join(directory, "data"))
 		return err
 	}
 	// if there are no issues, just remove the zip file from hard drive.
-	os.Remove("data.zip")
+	os.Remove(zipFile)
 	return nil
 }
 
@@ -121,19 +124,28 @@ func (wrappedDataStream *DataStream) decodeTransfer() error {
 // <bootstrapNodeAddress> is a parameter of string type that is the
 // IPFS address of the node that receiving the request to transfer the files
 func (node *PeerNode) RequestSync(bootstrapNodeAddress string) {
+	err := node.requestSync(bootstrapNodeAddress)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// requestSync does the work of <RequestSync> and returns its error instead
+// of panicking, so that the relay demo and the WebSocket check can report it
+func (node *PeerNode) requestSync(bootstrapNodeAddress string) error {
 	// First, we add the peer node <bootstrapNodeAddress> string points to
 	// <node> local address book
 
 	peerID, err := addAddressToPeerstore(node, bootstrapNodeAddress)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	// <node> creates a news tream by calling  <NewStream>
-	// function and passing background context, receiver's
+	// function and passing a relay friendly context, receiver's
 	// <peerID> and <paymentProtocol> (<"/sync/1.0.0">)
-	stream, err := node.NewStream(context.Background(), peerID, syncProtocol)
+	stream, err := node.NewStream(streamContext(syncProtocol), peerID, syncProtocol)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	// we make sure the stream gets closed at the end of the function call by
 	// using defer keyword before <stream.Close()>.
@@ -142,12 +154,8 @@ func (node *PeerNode) RequestSync(bootstrapNodeAddress string) {
 	// <stream> stream and save it in variable <wrappedDataStream>
 	wrappedDataStream := WrapDataStream(stream)
 	// Call <decodeTransfer()> to save the received Zip file on disk and
-	// extract it.
-	err = wrappedDataStream.decodeTransfer()
-	if err != nil {
-		panic(err)
-	}
-
+	// extract it in the sync directory of <node>.
+	return wrappedDataStream.decodeTransfer(node.syncDirectory)
 }
 
 // encodeFile is the function in which all the files in </data>
@@ -194,6 +202,12 @@ func (node *PeerNode) SyncProtocolMultiplexer() {
 	// with the same string attached is received by a node,that code
 	// inside anonymous function is executed on the receiver node
 	node.SetStreamHandler(syncProtocol, func(stream net.Stream) {
+		// refuse the stream if the remote peer is not allowed to use
+		// this protocol
+		if !node.streamAllowed(syncProtocol, stream.Conn().RemotePeer()) {
+			stream.Reset()
+			return
+		}
 		fmt.Println("Sync intiated!")
 		// it uses <WrapDataStream (stream net.Stream)> function to wrap
 		// <stream> stream and save it in variable <wrappedDataStream>
@@ -0,0 +1,352 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	net "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	peerstore "github.com/libp2p/go-libp2p-peerstore"
+	multiaddr "github.com/multiformats/go-multiaddr"
+)
+
+// Topology protocol is used to ask a node which peers it can reach and how
+// fast. The asking node opens the stream and the other node writes its
+// table and closes it, so nothing is read from the asking node.
+const topologyProtocol = "/topology/1.0.0"
+
+// maxTopologyNodes is how many nodes the <topology> command asks at most
+const maxTopologyNodes = 256
+
+// topologyConcurrency is how many nodes the <topology> command asks at the
+// same time
+const topologyConcurrency = 8
+
+// TopologyLink is one row of the table a node shares: what it knows about
+// reaching <Peer>. <RTT> is the average round trip time of the last
+// heartbeats and is 0 when none was answered.
+// <State> is the state of the heartbeat monitor or the cluster membership,
+// whichever knows the peer.
+type TopologyLink struct {
+	Peer      string
+	Addrs     []string
+	Reachable bool
+	State     string
+	RTT       time.Duration
+	LastSeen  time.Time
+}
+
+// TopologyTable is the message a node answers a topology request with
+type TopologyTable struct {
+	Peer  string
+	Time  time.Time
+	Links []TopologyLink
+}
+
+// TopologyNode is a node of the topology graph. <Reported> is true when
+// the node shared its table, and <Error> says why it did not.
+type TopologyNode struct {
+	ID       string
+	Reported bool
+	Error    string `json:",omitempty"`
+}
+
+// TopologyEdge is a link of the topology graph: <From> reaches <To> or not,
+// with the average round trip time in milliseconds.
+type TopologyEdge struct {
+	From      string
+	To        string
+	Reachable bool
+	State     string
+	RTT       float64
+}
+
+// TopologyGraph is a struct that holds who can reach whom and how fast, as
+// reported by every node that answered.
+type TopologyGraph struct {
+	Time  time.Time
+	Nodes []TopologyNode
+	Edges []TopologyEdge
+}
+
+// topologyTable collects the table <node> shares with others: every peer
+// of the heartbeat monitor and of the cluster membership.
+func (node *PeerNode) topologyTable() TopologyTable {
+	links := make(map[peer.ID]*TopologyLink)
+	linkOf := func(peerID peer.ID) *TopologyLink {
+		link, ok := links[peerID]
+		if !ok {
+			link = &TopologyLink{Peer: peer.IDB58Encode(peerID)}
+			for _, address := range node.Peerstore().Addrs(peerID) {
+				link.Addrs = append(link.Addrs, address.String())
+			}
+			if stats, ok := node.LatencyStats(peerID); ok {
+				link.RTT = stats.Avg
+			}
+			links[peerID] = link
+		}
+		return link
+	}
+	for _, member := range node.Members() {
+		link := linkOf(member.ID)
+		link.State = member.State.String()
+		link.Reachable = member.State == MemberAlive
+	}
+	// the monitor checks its peers on every interval, so it wins over the
+	// membership when both know a peer
+	for _, status := range node.Monitor().Snapshot() {
+		link := linkOf(status.Peer)
+		link.State = status.State.String()
+		link.Reachable = status.State == PeerUp
+		link.LastSeen = status.LastSeen
+	}
+	table := TopologyTable{Peer: peer.IDB58Encode(node.ID()), Time: time.Now()}
+	for _, link := range links {
+		table.Links = append(table.Links, *link)
+	}
+	sort.Slice(table.Links, func(i, j int) bool {
+		return table.Links[i].Peer < table.Links[j].Peer
+	})
+	return table
+}
+
+// handleTopology is the stream handler of <"/topology/1.0.0">. It writes
+// the table of <node> to <stream>.
+func (node *PeerNode) handleTopology(stream net.Stream) {
+	// refuse the stream if the remote peer is not allowed to use this
+	// protocol or asks too often. Topology requests share the limits of the
+	// heartbeat handlers, since building a table is more work than
+	// answering a heartbeat.
+	release, ok := node.admitHeartbeat(topologyProtocol, stream)
+	if !ok {
+		return
+	}
+	defer release()
+	stream.SetWriteDeadline(time.Now().Add(defaultHeartbeatTimeout))
+	wrappedStream := WrapDataStream(stream)
+	table := node.topologyTable()
+	err := wrappedStream.encoder.Encode(&table)
+	if err == nil {
+		err = wrappedStream.writer.Flush()
+	}
+	if err != nil {
+		fmt.Println(err)
+		stream.Reset()
+		return
+	}
+	stream.Close()
+}
+
+// requestTopology asks <peerID> for its table
+func (node *PeerNode) requestTopology(peerID peer.ID) (*TopologyTable, error) {
+	ctx, cancel := context.WithTimeout(streamContext(topologyProtocol), defaultHeartbeatTimeout)
+	defer cancel()
+	stream, err := node.NewStream(ctx, peerID, topologyProtocol)
+	if err != nil {
+		return nil, err
+	}
+	stream.SetDeadline(time.Now().Add(defaultHeartbeatTimeout))
+	// the table is read through a bounded reader like a heartbeat reply
+	wrappedStream, _ := node.heartbeatLimiter.wrapBoundedDataStream(stream)
+	var table TopologyTable
+	err = wrappedStream.decoder.Decode(&table)
+	if err != nil {
+		stream.Reset()
+		return nil, err
+	}
+	stream.Close()
+	if table.Peer != peer.IDB58Encode(peerID) {
+		return nil, fmt.Errorf("topology table of %s claims to be from %s", peerID, table.Peer)
+	}
+	return &table, nil
+}
+
+// Topology gathers the tables of <node> and of every node it can find
+// through them into one graph. It starts with the peers <node> knows and
+// follows the links of every table it gets, up to <maxTopologyNodes> nodes.
+// ----------------------------------------------------------------------------
+// Nodes that cannot be asked are still in the graph, without a table, so
+// partitions show up as nodes that nobody can reach.
+func (node *PeerNode) Topology() *TopologyGraph {
+	self := peer.IDB58Encode(node.ID())
+	graph := &TopologyGraph{Time: time.Now()}
+	nodes := map[string]*TopologyNode{self: {ID: self, Reported: true}}
+	var mutex sync.Mutex
+	var queue []peer.ID
+	// addTable adds the links of <table> to the graph and queues every
+	// peer in it that was not seen yet
+	addTable := func(table *TopologyTable) {
+		for _, link := range table.Links {
+			graph.Edges = append(graph.Edges, TopologyEdge{
+				From:      table.Peer,
+				To:        link.Peer,
+				Reachable: link.Reachable,
+				State:     link.State,
+				RTT:       float64(link.RTT) / float64(time.Millisecond),
+			})
+			if _, ok := nodes[link.Peer]; ok || len(nodes) >= maxTopologyNodes {
+				continue
+			}
+			peerID, err := peer.IDB58Decode(link.Peer)
+			if err != nil {
+				continue
+			}
+			for _, address := range link.Addrs {
+				decoded, err := multiaddr.NewMultiaddr(address)
+				if err == nil {
+					node.Peerstore().AddAddr(peerID, decoded, peerstore.TempAddrTTL)
+				}
+			}
+			nodes[link.Peer] = &TopologyNode{ID: link.Peer}
+			queue = append(queue, peerID)
+		}
+	}
+	ownTable := node.topologyTable()
+	addTable(&ownTable)
+	for len(queue) > 0 {
+		batch := queue
+		queue = nil
+		// the nodes of one round are asked in parallel, a few at a time
+		var wait sync.WaitGroup
+		slots := make(chan struct{}, topologyConcurrency)
+		for _, peerID := range batch {
+			wait.Add(1)
+			slots <- struct{}{}
+			go func(peerID peer.ID) {
+				defer wait.Done()
+				defer func() { <-slots }()
+				table, err := node.requestTopology(peerID)
+				mutex.Lock()
+				defer mutex.Unlock()
+				entry := nodes[peer.IDB58Encode(peerID)]
+				if err != nil {
+					entry.Error = err.Error()
+					return
+				}
+				entry.Reported = true
+				addTable(table)
+			}(peerID)
+		}
+		wait.Wait()
+	}
+	for _, entry := range nodes {
+		graph.Nodes = append(graph.Nodes, *entry)
+	}
+	sort.Slice(graph.Nodes, func(i, j int) bool {
+		return graph.Nodes[i].ID < graph.Nodes[j].ID
+	})
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		if graph.Edges[i].From != graph.Edges[j].From {
+			return graph.Edges[i].From < graph.Edges[j].From
+		}
+		return graph.Edges[i].To < graph.Edges[j].To
+	})
+	return graph
+}
+
+// JSON returns <graph> as indented JSON
+func (graph *TopologyGraph) JSON() ([]byte, error) {
+	return json.MarshalIndent(graph, "", "  ")
+}
+
+// DOT returns <graph> in the Graphviz DOT language. Reachable links are
+// solid and labeled with their round trip time, unreachable links are red
+// and dashed, and nodes that did not share a table are gray.
+func (graph *TopologyGraph) DOT() []byte {
+	var builder strings.Builder
+	builder.WriteString("digraph topology {\n")
+	builder.WriteString("  node [shape=box, fontname=\"monospace\"];\n")
+	for _, entry := range graph.Nodes {
+		attributes := fmt.Sprintf("label=%q", shortPeerID(entry.ID))
+		if !entry.Reported {
+			attributes += ", style=filled, fillcolor=gray"
+		}
+		fmt.Fprintf(&builder, "  %q [%s];\n", entry.ID, attributes)
+	}
+	for _, edge := range graph.Edges {
+		var attributes string
+		if edge.Reachable {
+			attributes = fmt.Sprintf("label=\"%.1fms\"", edge.RTT)
+		} else {
+			attributes = fmt.Sprintf("label=%q, color=red, style=dashed", edge.State)
+		}
+		fmt.Fprintf(&builder, "  %q -> %q [%s];\n", edge.From, edge.To, attributes)
+	}
+	builder.WriteString("}\n")
+	return []byte(builder.String())
+}
+
+// String returns a summary of <graph> that can be shown in the shell
+func (graph *TopologyGraph) String() string {
+	reported, reachable := 0, 0
+	for _, entry := range graph.Nodes {
+		if entry.Reported {
+			reported++
+		}
+	}
+	for _, edge := range graph.Edges {
+		if edge.Reachable {
+			reachable++
+		}
+	}
+	result := fmt.Sprintf("Nodes: %d (%d shared their table)\nLinks: %d (%d reachable)\n",
+		len(graph.Nodes), reported, len(graph.Edges), reachable)
+	for _, entry := range graph.Nodes {
+		if entry.Error != "" {
+			result += fmt.Sprintf("  %s: %s\n", shortPeerID(entry.ID), entry.Error)
+		}
+	}
+	return result
+}
+
+// Export writes <graph> to <name>.dot and <name>.json
+func (graph *TopologyGraph) Export(name string) error {
+	data, err := graph.JSON()
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(name+".json", data, 0644)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name+".dot", graph.DOT(), 0644)
+}
+
+// shortPeerID returns the last characters of a base 58 peer ID, which is
+// enough to tell the nodes of a graph apart
+func shortPeerID(id string) string {
+	if len(id) <= 8 {
+		return id
+	}
+	return "*" + id[len(id)-8:]
+}
@@ -0,0 +1,167 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	websocket "github.com/libp2p/go-ws-transport"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// webSocketAddress returns the loopback IPFS address of the WebSocket
+// listener of <node>.
+// ----------------------------------------------------------------------------
+// it returns an error if <node> does not listen on WebSocket
+func (node *PeerNode) webSocketAddress() (string, error) {
+	for _, address := range node.Addrs() {
+		if manet.IsIPLoopback(address) && strings.HasSuffix(address.String(), "/ws") {
+			return fmt.Sprintf("%s/ipfs/%s", address, node.ID().Pretty()), nil
+		}
+	}
+	return "", fmt.Errorf("node does not listen on a /ws address")
+}
+
+// WebSocketReport is a struct that holds what the WebSocket check did, so
+// that it can be shown in the shell and checked by the tests.
+// <Receipt> is the receipt of the payment and <Connections> are the remote
+// addresses of every connection from the client to the node.
+type WebSocketReport struct {
+	Heartbeat   *HeartbeatResult
+	Receipt     *TransactionReceipt
+	Synced      bool
+	Connections []string
+}
+
+// WebSocketCheck runs heartbeat, payment and sync against the WebSocket
+// listener of <node> on loopback. The client is a separate node in the same
+// process that only has the WebSocket transport, so every stream has to
+// go through WebSocket.
+// Sync is only run when there is a <data> directory to send. The client
+// stores what it receives in a temporary directory, so it does not
+// overwrite the <data> directory of <node> while <node> sends it.
+// ----------------------------------------------------------------------------
+// <node> is a receiver of pointer type to <PeerNode>. Its heartbeat, payment
+// and sync handlers are mounted by this function.
+// <config> is a parameter of pointer type to <Config> that holds the private
+// network key the client needs, if there is one.
+// ----------------------------------------------------------------------------
+// It returns an error in case the WebSocket connection could not be set up
+// or one of the protocols failed over it.
+func (node *PeerNode) WebSocketCheck(config *Config) error {
+	report, err := node.runWebSocketCheck(config)
+	if err != nil {
+		return err
+	}
+	if report.Synced {
+		fmt.Println("Heartbeat, payment and sync worked over WebSocket")
+	} else {
+		fmt.Println("Heartbeat and payment worked over WebSocket")
+	}
+	return nil
+}
+
+// runWebSocketCheck does the work of <WebSocketCheck>.
+// ----------------------------------------------------------------------------
+// it returns a pointer to <WebSocketReport> with what the check did.
+// It returns an error in case a step of the check failed, or the client
+// reached <node> without WebSocket.
+func (node *PeerNode) runWebSocketCheck(config *Config) (*WebSocketReport, error) {
+	address, err := node.webSocketAddress()
+	if err != nil {
+		return nil, err
+	}
+	node.HeartbeatProtocolMultiplexer()
+	node.PaymentProtocolMultiplexer()
+	node.SyncProtocolMultiplexer()
+
+	// The client does not listen at all, it only dials over WebSocket.
+	options := []libp2p.Option{
+		libp2p.Transport(websocket.New),
+		libp2p.NoListenAddrs,
+	}
+	if config.PrivateNetworkKeyFile != "" {
+		psk, err := loadPrivateNetworkKey(config.PrivateNetworkKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, libp2p.PrivateNetwork(psk))
+	}
+	clientHost, err := libp2p.New(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+	defer clientHost.Close()
+	gater, err := LoadConnectionGater(config.ACLFile)
+	if err != nil {
+		return nil, err
+	}
+	client := wrapHost(clientHost, gater, config)
+	client.syncDirectory, err = ioutil.TempDir("", "ws-check")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(client.syncDirectory)
+
+	fmt.Printf("WebSocket client %s dialing %s\n", client.ID(), address)
+	report := &WebSocketReport{}
+	report.Heartbeat, err = client.checkHeartbeat(address)
+	if err != nil {
+		return nil, fmt.Errorf("heartbeat over WebSocket: %s", err)
+	}
+	fmt.Printf("Heartbeat over WebSocket answered in %s\n", report.Heartbeat.RTT)
+	report.Receipt, err = client.sendPayment(address, Money{Units: 1, Asset: config.DefaultAsset}, "")
+	if err != nil {
+		return nil, fmt.Errorf("payment over WebSocket: %s", err)
+	}
+	if _, err := os.Stat("data"); err == nil {
+		err = client.requestSync(address)
+		if err != nil {
+			return nil, fmt.Errorf("sync over WebSocket: %s", err)
+		}
+		report.Synced = true
+		fmt.Println("Sync over WebSocket finished")
+	} else {
+		fmt.Println("Skipping sync: there is no data directory")
+	}
+	// there has to be a connection, and every connection has to be a
+	// WebSocket one, otherwise the check did not test anything
+	conns := client.Network().ConnsToPeer(node.ID())
+	if len(conns) == 0 {
+		return nil, fmt.Errorf("client has no connection to the node")
+	}
+	for _, conn := range conns {
+		if !strings.Contains(conn.RemoteMultiaddr().String(), "/ws") {
+			return nil, fmt.Errorf("client reached the node without WebSocket at %s", conn.RemoteMultiaddr())
+		}
+		report.Connections = append(report.Connections, conn.RemoteMultiaddr().String())
+	}
+	return report, nil
+}
@@ -0,0 +1,74 @@
+/*The MIT License (MIT)
+* Copyright (c) 2018 Damoon Azarpazhooh
+* Permission is hereby granted, free of charge, to any person
+* obtaining a copy of this software and associated
+* documentation files (the "Software"), to deal in the
+* Software without restriction, including without limitation
+* the rights to use, copy, modify, merge, publish, distribute,
+* sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so,
+* subject to the following conditions:
+*
+* The above copyright notice and this permission notice
+* shall be included in all copies or substantial portions of
+* the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF
+* ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+* THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR
+* PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+* OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+* OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+* OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+* SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testConfig returns the default settings with every file in a temporary
+// directory and without the listeners and services that would clash
+// between tests
+func testConfig(t *testing.T) *Config {
+	directory := t.TempDir()
+	config := DefaultConfig()
+	config.ACLFile = filepath.Join(directory, "acl.json")
+	config.HistoryFile = ""
+	config.HealthAddress = ""
+	config.LedgerFile = ""
+	config.ReceiptsDirectory = ""
+	config.Presence = false
+	config.Relays = nil
+	config.MonitoredPeers = nil
+	return config
+}
+
+// TestWebSocketCheck runs heartbeat and payment between a node and a client
+// that can only dial over WebSocket, both on loopback
+func TestWebSocketCheck(t *testing.T) {
+	config := testConfig(t)
+	node := InitializePeer(0, config)
+	defer node.Close()
+	report, err := node.runWebSocketCheck(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Heartbeat == nil || report.Heartbeat.Peer != node.ID() || report.Heartbeat.RTT <= 0 {
+		t.Fatalf("heartbeat over WebSocket was not answered by the node: %+v", report.Heartbeat)
+	}
+	if report.Receipt == nil || !report.Receipt.Accepted || report.Receipt.Code != ReceiptAccepted {
+		t.Fatalf("payment over WebSocket was not accepted: %+v", report.Receipt)
+	}
+	if len(report.Connections) == 0 {
+		t.Fatal("client has no connection to the node")
+	}
+	for _, address := range report.Connections {
+		if !strings.Contains(address, "/ws") {
+			t.Fatalf("client reached the node at %s without WebSocket", address)
+		}
+	}
+}